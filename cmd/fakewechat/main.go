@@ -0,0 +1,55 @@
+// Command fakewechat serves the fake WeChat API server from package
+// wechattest, for running the auth server end to end without WeChat. It
+// accepts the apps configured in the auth server's config file; point the
+// auth server's wechat.api_base_url at it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/wechattest"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	configPath := flag.String("config", "", "path to the auth server's YAML config file, whose WeChat apps are accepted")
+	accessTokenTTL := flag.Duration("access-token-ttl", 2*time.Hour, "lifetime of the access tokens issued")
+	flag.Parse()
+
+	// Load configuration like the auth server, including its environment variables
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	server := wechattest.NewServer()
+	server.AccessTokenTTL = *accessTokenTTL
+
+	apps := cfg.WeChat.AllApps()
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		app := apps[name]
+		if app.AppID == "" {
+			continue
+		}
+		server.AddApp(app.AppID, app.AppSecret)
+		log.Printf("Accepting app %s (%s)", name, app.AppID)
+	}
+	if len(names) == 0 {
+		log.Println("No WeChat apps configured, every call will answer invalid appid")
+	}
+
+	log.Println("Fake WeChat API listening on", *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
@@ -1,72 +1,640 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the application
 type Config struct {
-	Redis  RedisConfig
-	JWT    JWTConfig
-	Server ServerConfig
-	WeChat WeChatConfig
-	Ngrok  NgrokConfig
+	Storage StorageConfig `yaml:"storage"`
+	Redis   RedisConfig   `yaml:"redis"`
+	JWT     JWTConfig     `yaml:"jwt"`
+	Server  ServerConfig  `yaml:"server"`
+	OAuth   OAuthConfig   `yaml:"oauth"`
+	WeChat  WeChatConfig  `yaml:"wechat"`
+	Ngrok   NgrokConfig   `yaml:"ngrok"`
+
+	// fileErrs are the problems found in the config file, such as unknown
+	// keys, reported by Validate with the others
+	fileErrs []error
 }
 
-// WeChatConfig holds WeChat Mini Program configuration
+// MinSecretKeyLength is the minimum length of the JWT HMAC secret
+const MinSecretKeyLength = 32
+
+// Supported JWT signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// Scopes of the proxied data APIs
+const (
+	ScopeHouseRead   = "house:read"
+	ScopeFortuneRead = "fortune:read"
+)
+
+// KnownScopes lists every scope checked by a route
+var KnownScopes = []string{ScopeHouseRead, ScopeFortuneRead}
+
+// DefaultWeChatAPIBaseURL is the base URL of WeChat's server APIs
+const DefaultWeChatAPIBaseURL = "https://api.weixin.qq.com"
+
+// DefaultWeChatAuthorizeURL is WeChat's OAuth2 authorize page for Official Accounts
+const DefaultWeChatAuthorizeURL = "https://open.weixin.qq.com/connect/oauth2/authorize"
+
+// DefaultWeChatApp is the name of the app configured by wechat.app_id and wechat.app_secret
+const DefaultWeChatApp = "default"
+
+// Supported WeChat app types
+const (
+	WeChatAppMiniProgram     = "mini_program"
+	WeChatAppOfficialAccount = "official_account"
+)
+
+// WeChatConfig holds the configuration of the WeChat apps users log in from
 type WeChatConfig struct {
-	AppID     string
-	AppSecret string
+	// Enabled serves the WeChat login routes. It is off by default, so a
+	// server that only uses password logins needs no WeChat settings.
+	Enabled bool `yaml:"enabled"`
+	// AppID and AppSecret configure a Mini Program named "default", which is
+	// all a single-app deployment needs
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+	// Apps are further apps by name. The name is part of the identities of
+	// the app's users, so an app must not be renamed.
+	Apps map[string]WeChatAppConfig `yaml:"apps"`
+	// DefaultApp is the app of requests that do not name one
+	DefaultApp string `yaml:"default_app"`
+	// APIBaseURL is where WeChat's server APIs are called, e.g. a local fake in tests
+	APIBaseURL string `yaml:"api_base_url"`
+	// AuthorizeURL is the authorize page Official Account users are sent to
+	AuthorizeURL string `yaml:"authorize_url"`
+	// RequestTimeout bounds each attempt of a call to a WeChat API
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// MaxAttempts is how often a call failing with a transient error, such as
+	// a network error or errcode -1, is tried before giving up
+	MaxAttempts int `yaml:"max_attempts"`
+	// SessionKeyTTL is how long a user's session_key is kept after wx.login.
+	// WeChat does not publish its lifetime, and a new wx.login replaces it.
+	SessionKeyTTL time.Duration `yaml:"session_key_ttl"`
+	// OAuthStateTTL is how long a user has to authorize an Official Account
+	// web login before it expires
+	OAuthStateTTL time.Duration `yaml:"oauth_state_ttl"`
+}
+
+// WeChatAppConfig holds the credentials of one WeChat app
+type WeChatAppConfig struct {
+	// Type is "mini_program" (the default) or "official_account"
+	Type      string `yaml:"type"`
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+	// RedirectURL is the public URL of /wechat/oauth/callback, used by
+	// Official Accounts only. Its domain must be registered as the account's
+	// web authorization domain.
+	RedirectURL string `yaml:"redirect_url"`
+	// ReturnURLs are the H5 pages a web login may return to, used by
+	// Official Accounts only. A page matches if it equals one of them
+	// except for its query.
+	ReturnURLs []string `yaml:"return_urls"`
+}
+
+// AllApps returns every configured app by name, including the default
+// Mini Program from AppID and AppSecret
+func (c *WeChatConfig) AllApps() map[string]WeChatAppConfig {
+	apps := make(map[string]WeChatAppConfig, len(c.Apps)+1)
+	if c.AppID != "" || c.AppSecret != "" {
+		apps[DefaultWeChatApp] = WeChatAppConfig{AppID: c.AppID, AppSecret: c.AppSecret}
+	}
+	for name, app := range c.Apps {
+		apps[name] = app
+	}
+	for name, app := range apps {
+		if app.Type == "" {
+			app.Type = WeChatAppMiniProgram
+			apps[name] = app
+		}
+	}
+	return apps
+}
+
+// App returns the app called name, or the default app when name is empty
+func (c *WeChatConfig) App(name string) (string, WeChatAppConfig, bool) {
+	if name == "" {
+		name = c.DefaultApp
+	}
+	app, ok := c.AllApps()[name]
+	return name, app, ok
+}
+
+// HasAppType reports whether an app of the given type is configured
+func (c *WeChatConfig) HasAppType(appType string) bool {
+	for _, app := range c.AllApps() {
+		if app.Type == appType {
+			return true
+		}
+	}
+	return false
+}
+
+// Supported user storage drivers
+const (
+	StorageDriverRedis    = "redis"
+	StorageDriverMemory   = "memory"
+	StorageDriverSQLite   = "sqlite"
+	StorageDriverPostgres = "postgres"
+)
+
+// StorageConfig selects where user accounts are stored
+type StorageConfig struct {
+	// Driver is "redis", "memory", "sqlite" or "postgres". The memory driver
+	// also runs Redis in process, loses everything on restart and is meant
+	// for tests and local development.
+	Driver string `yaml:"driver"`
+	// DSN is the database connection string for the sqlite and postgres drivers
+	DSN string `yaml:"dsn"`
 }
 
 // RedisConfig holds Redis configuration
 type RedisConfig struct {
-	Addr     string
-	Password string
-	DB       int
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
 }
 
 // JWTConfig holds JWT configuration
 type JWTConfig struct {
-	SecretKey       string
-	AccessTokenTTL  time.Duration
-	RefreshTokenTTL time.Duration
+	// Algorithm is one of HS256, RS256, ES256 or EdDSA
+	Algorithm string `yaml:"algorithm"`
+	// SecretKey is the shared HMAC secret, used only with HS256
+	SecretKey string `yaml:"secret_key"`
+	// PrivateKeyFile and PublicKeyFile are PEM files used by the asymmetric
+	// algorithms. The public key is derived from the private key when omitted.
+	PrivateKeyFile string `yaml:"private_key_file"`
+	PublicKeyFile  string `yaml:"public_key_file"`
+	// KeyID is the kid of the active signing key. It defaults to the key's
+	// RFC 7638 thumbprint for asymmetric algorithms.
+	KeyID string `yaml:"key_id"`
+	// VerificationKeys are retired keys whose tokens are still accepted
+	VerificationKeys []JWTKeyConfig `yaml:"verification_keys"`
+	AccessTokenTTL   time.Duration  `yaml:"access_token_ttl"`
+	RefreshTokenTTL  time.Duration  `yaml:"refresh_token_ttl"`
+	// DenylistCacheTTL is how long each instance caches a "not revoked"
+	// answer for an access token before asking Redis again
+	DenylistCacheTTL time.Duration `yaml:"denylist_cache_ttl"`
+	// Scopes are granted to every user's access tokens
+	Scopes []string `yaml:"scopes"`
+	// RoleScopes are granted in addition to users with the role
+	RoleScopes map[string][]string `yaml:"role_scopes"`
+}
+
+// ScopesFor returns the scopes a user with roles is entitled to, sorted
+func (c *JWTConfig) ScopesFor(roles []string) []string {
+	seen := make(map[string]bool)
+	var scopes []string
+	add := func(list []string) {
+		for _, scope := range list {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	add(c.Scopes)
+	for _, role := range roles {
+		add(c.RoleScopes[role])
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// JWTKeyConfig describes a verification-only JWT key
+type JWTKeyConfig struct {
+	ID string `yaml:"id"`
+	// Algorithm defaults to the active key's algorithm
+	Algorithm     string `yaml:"algorithm"`
+	SecretKey     string `yaml:"secret_key"`
+	PublicKeyFile string `yaml:"public_key_file"`
 }
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
-	Port     string
-	ProxyURL string
+	Port     string `yaml:"port"`
+	ProxyURL string `yaml:"proxy_url"`
 }
 
+// OAuthConfig holds the configuration of the OAuth2 authorization server
+type OAuthConfig struct {
+	// CodeTTL is how long an authorization code can be exchanged for tokens
+	CodeTTL time.Duration `yaml:"code_ttl"`
+}
+
+// NgrokConfig holds ngrok tunnel configuration
 type NgrokConfig struct {
-	HostName string
+	HostName string `yaml:"host_name"`
 }
 
-// GetConfig returns the application configuration
-func GetConfig() *Config {
+// Default returns the built-in configuration used when neither the config
+// file nor the environment sets a value
+func Default() *Config {
 	return &Config{
+		Storage: StorageConfig{
+			Driver: StorageDriverRedis,
+		},
 		Redis: RedisConfig{
 			Addr:     "localhost:6379",
 			Password: "",
 			DB:       0,
 		},
 		JWT: JWTConfig{
-			SecretKey:       os.Getenv("JWT_SECRET_KEY"),
-			AccessTokenTTL:  15 * time.Minute,
-			RefreshTokenTTL: 7 * 24 * time.Hour,
+			Algorithm:        AlgorithmHS256,
+			AccessTokenTTL:   15 * time.Minute,
+			RefreshTokenTTL:  7 * 24 * time.Hour,
+			DenylistCacheTTL: 10 * time.Second,
+			Scopes:           []string{ScopeHouseRead, ScopeFortuneRead},
 		},
 		Server: ServerConfig{
 			Port:     "8081",
 			ProxyURL: "http://localhost:8080",
 		},
-		WeChat: WeChatConfig{
-			AppID:     os.Getenv("WECHAT_APPID"),
-			AppSecret: os.Getenv("WECHAT_APPSECRET"),
+		OAuth: OAuthConfig{
+			CodeTTL: time.Minute,
 		},
-		Ngrok: NgrokConfig{
-			HostName: os.Getenv("HOST_NAME"), //"https://mosquito-selected-macaw.ngrok-free.app",
+		WeChat: WeChatConfig{
+			DefaultApp:     DefaultWeChatApp,
+			APIBaseURL:     DefaultWeChatAPIBaseURL,
+			AuthorizeURL:   DefaultWeChatAuthorizeURL,
+			RequestTimeout: 5 * time.Second,
+			MaxAttempts:    3,
+			SessionKeyTTL:  24 * time.Hour,
+			OAuthStateTTL:  10 * time.Minute,
 		},
 	}
 }
+
+// Load builds the configuration from the defaults, the YAML file at path
+// (skipped when path is empty) and finally the environment variables, with
+// later sources taking precedence
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// Unknown keys are most likely misspelled ones, which would be ignored
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+			}
+			for _, msg := range typeErr.Errors {
+				cfg.fileErrs = append(cfg.fileErrs, fmt.Errorf("%s: %s", path, msg))
+			}
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyEnv overrides configuration values with any environment variables that are set
+func (c *Config) applyEnv() error {
+	setString(&c.Storage.Driver, "STORAGE_DRIVER")
+	setString(&c.Storage.DSN, "STORAGE_DSN")
+
+	setString(&c.Redis.Addr, "REDIS_ADDR")
+	setString(&c.Redis.Password, "REDIS_PASSWORD")
+	if err := setInt(&c.Redis.DB, "REDIS_DB"); err != nil {
+		return err
+	}
+
+	setString(&c.JWT.Algorithm, "JWT_ALGORITHM")
+	setString(&c.JWT.SecretKey, "JWT_SECRET_KEY")
+	setString(&c.JWT.PrivateKeyFile, "JWT_PRIVATE_KEY_FILE")
+	setString(&c.JWT.PublicKeyFile, "JWT_PUBLIC_KEY_FILE")
+	setString(&c.JWT.KeyID, "JWT_KEY_ID")
+	if err := setDuration(&c.JWT.AccessTokenTTL, "JWT_ACCESS_TOKEN_TTL"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.JWT.RefreshTokenTTL, "JWT_REFRESH_TOKEN_TTL"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.JWT.DenylistCacheTTL, "JWT_DENYLIST_CACHE_TTL"); err != nil {
+		return err
+	}
+	setList(&c.JWT.Scopes, "JWT_SCOPES")
+
+	setString(&c.Server.Port, "SERVER_PORT")
+	setString(&c.Server.ProxyURL, "PROXY_URL")
+
+	if err := setDuration(&c.OAuth.CodeTTL, "OAUTH_CODE_TTL"); err != nil {
+		return err
+	}
+
+	if err := setBool(&c.WeChat.Enabled, "WECHAT_ENABLED"); err != nil {
+		return err
+	}
+	setString(&c.WeChat.AppID, "WECHAT_APPID")
+	setString(&c.WeChat.AppSecret, "WECHAT_APPSECRET")
+	setString(&c.WeChat.DefaultApp, "WECHAT_DEFAULT_APP")
+	setString(&c.WeChat.APIBaseURL, "WECHAT_API_BASE_URL")
+	setString(&c.WeChat.AuthorizeURL, "WECHAT_AUTHORIZE_URL")
+	if err := setDuration(&c.WeChat.RequestTimeout, "WECHAT_REQUEST_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := setInt(&c.WeChat.MaxAttempts, "WECHAT_MAX_ATTEMPTS"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.WeChat.SessionKeyTTL, "WECHAT_SESSION_KEY_TTL"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.WeChat.OAuthStateTTL, "WECHAT_OAUTH_STATE_TTL"); err != nil {
+		return err
+	}
+
+	setString(&c.Ngrok.HostName, "HOST_NAME")
+
+	return nil
+}
+
+// Validate checks the configuration and reports every problem found at once
+func (c *Config) Validate() error {
+	errs := slices.Clone(c.fileErrs)
+
+	switch c.Storage.Driver {
+	case StorageDriverRedis, StorageDriverMemory:
+	case StorageDriverSQLite, StorageDriverPostgres:
+		if c.Storage.DSN == "" {
+			errs = append(errs, fmt.Errorf("storage.dsn is required for %s", c.Storage.Driver))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.driver %q is not supported", c.Storage.Driver))
+	}
+
+	// The memory driver runs Redis in process
+	if c.Redis.Addr == "" && c.Storage.Driver != StorageDriverMemory {
+		errs = append(errs, errors.New("redis.addr is required"))
+	}
+
+	switch c.JWT.Algorithm {
+	case AlgorithmHS256:
+		if len(c.JWT.SecretKey) < MinSecretKeyLength {
+			errs = append(errs, fmt.Errorf("jwt.secret_key must be at least %d characters", MinSecretKeyLength))
+		}
+	case AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA:
+		if c.JWT.PrivateKeyFile == "" {
+			errs = append(errs, fmt.Errorf("jwt.private_key_file is required for %s", c.JWT.Algorithm))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("jwt.algorithm %q is not supported", c.JWT.Algorithm))
+	}
+	seen := map[string]bool{c.JWT.KeyID: true}
+	for i, k := range c.JWT.VerificationKeys {
+		if k.ID == "" {
+			errs = append(errs, fmt.Errorf("jwt.verification_keys[%d].id is required", i))
+		} else if seen[k.ID] {
+			errs = append(errs, fmt.Errorf("jwt.verification_keys[%d].id %q is used more than once", i, k.ID))
+		}
+		seen[k.ID] = true
+
+		alg := k.Algorithm
+		if alg == "" {
+			alg = c.JWT.Algorithm
+		}
+		switch alg {
+		case AlgorithmHS256:
+			if len(k.SecretKey) < MinSecretKeyLength {
+				errs = append(errs, fmt.Errorf("jwt.verification_keys[%d].secret_key must be at least %d characters", i, MinSecretKeyLength))
+			}
+		case AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA:
+			if k.PublicKeyFile == "" {
+				errs = append(errs, fmt.Errorf("jwt.verification_keys[%d].public_key_file is required for %s", i, alg))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("jwt.verification_keys[%d].algorithm %q is not supported", i, alg))
+		}
+	}
+	if c.JWT.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("jwt.access_token_ttl must be positive"))
+	}
+	if c.JWT.RefreshTokenTTL <= 0 {
+		errs = append(errs, errors.New("jwt.refresh_token_ttl must be positive"))
+	}
+	if c.JWT.AccessTokenTTL > 0 && c.JWT.RefreshTokenTTL > 0 && c.JWT.AccessTokenTTL >= c.JWT.RefreshTokenTTL {
+		errs = append(errs, errors.New("jwt.access_token_ttl must be shorter than jwt.refresh_token_ttl"))
+	}
+	if c.JWT.DenylistCacheTTL < 0 {
+		errs = append(errs, errors.New("jwt.denylist_cache_ttl cannot be negative"))
+	}
+	errs = append(errs, validScopes("jwt.scopes", c.JWT.Scopes)...)
+	roles := make([]string, 0, len(c.JWT.RoleScopes))
+	for role := range c.JWT.RoleScopes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		errs = append(errs, validScopes("jwt.role_scopes."+role, c.JWT.RoleScopes[role])...)
+	}
+
+	if c.Server.Port == "" {
+		errs = append(errs, errors.New("server.port is required"))
+	} else if _, err := strconv.ParseUint(c.Server.Port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("server.port %q is not a valid port", c.Server.Port))
+	}
+	if u, err := url.Parse(c.Server.ProxyURL); err != nil {
+		errs = append(errs, fmt.Errorf("server.proxy_url is invalid: %w", err))
+	} else if u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("server.proxy_url %q must be an absolute URL", c.Server.ProxyURL))
+	}
+
+	if c.OAuth.CodeTTL <= 0 {
+		errs = append(errs, errors.New("oauth.code_ttl must be positive"))
+	}
+
+	if c.WeChat.Enabled {
+		errs = append(errs, c.WeChat.validate()...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the WeChat apps and settings
+func (c *WeChatConfig) validate() []error {
+	var errs []error
+
+	if _, ok := c.Apps[DefaultWeChatApp]; ok && (c.AppID != "" || c.AppSecret != "") {
+		errs = append(errs, fmt.Errorf("wechat.apps.%s conflicts with wechat.app_id, configure it in one place", DefaultWeChatApp))
+	}
+
+	apps := c.AllApps()
+	if len(apps) == 0 {
+		errs = append(errs, errors.New("wechat.app_id or wechat.apps is required when wechat is enabled"))
+	} else if _, ok := apps[c.DefaultApp]; !ok {
+		errs = append(errs, fmt.Errorf("wechat.default_app %q is not a configured app", c.DefaultApp))
+	}
+
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		app := apps[name]
+		key := "wechat.apps." + name
+		if _, ok := c.Apps[name]; !ok {
+			// The default app from wechat.app_id and wechat.app_secret
+			key = "wechat"
+		}
+		if strings.ContainsAny(name, ":/") {
+			errs = append(errs, fmt.Errorf("%s: app names cannot contain ':' or '/'", key))
+		}
+		if app.AppID == "" {
+			errs = append(errs, fmt.Errorf("%s.app_id is required", key))
+		}
+		if app.AppSecret == "" {
+			errs = append(errs, fmt.Errorf("%s.app_secret is required", key))
+		}
+		switch app.Type {
+		case WeChatAppMiniProgram:
+		case WeChatAppOfficialAccount:
+			errs = append(errs, absoluteURL(key+".redirect_url", app.RedirectURL))
+			if len(app.ReturnURLs) == 0 {
+				errs = append(errs, fmt.Errorf("%s.return_urls is required", key))
+			}
+			for _, returnURL := range app.ReturnURLs {
+				errs = append(errs, returnPage(key+".return_urls", returnURL))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.type %q is not supported", key, app.Type))
+		}
+	}
+
+	errs = append(errs, absoluteURL("wechat.api_base_url", c.APIBaseURL))
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("wechat.request_timeout must be positive"))
+	}
+	if c.MaxAttempts < 1 {
+		errs = append(errs, errors.New("wechat.max_attempts must be at least 1"))
+	}
+	if c.SessionKeyTTL <= 0 {
+		errs = append(errs, errors.New("wechat.session_key_ttl must be positive"))
+	}
+	if c.HasAppType(WeChatAppOfficialAccount) {
+		errs = append(errs, absoluteURL("wechat.authorize_url", c.AuthorizeURL))
+		if c.OAuthStateTTL <= 0 {
+			errs = append(errs, errors.New("wechat.oauth_state_ttl must be positive"))
+		}
+	}
+
+	return errs
+}
+
+// validScopes reports scopes, the setting at key, that are empty or contain
+// whitespace, which separates scopes in tokens
+func validScopes(key string, scopes []string) []error {
+	var errs []error
+	for i, scope := range scopes {
+		if scope == "" || strings.ContainsFunc(scope, unicode.IsSpace) {
+			errs = append(errs, fmt.Errorf("%s[%d] %q is not a valid scope", key, i, scope))
+		}
+	}
+	return errs
+}
+
+// absoluteURL reports an error if value, the setting at key, is not an absolute URL
+func absoluteURL(key, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s is invalid: %w", key, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%s %q must be an absolute URL", key, value)
+	}
+	return nil
+}
+
+// returnPage checks that value is an absolute URL without a query or
+// fragment, which return URLs are compared against
+func returnPage(key, value string) error {
+	if err := absoluteURL(key, value); err != nil {
+		return err
+	}
+	if strings.ContainsAny(value, "?#") {
+		return fmt.Errorf("%s %q cannot have a query or fragment", key, value)
+	}
+	return nil
+}
+
+func setString(dst *string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+// setList sets dst from a whitespace separated list
+func setList(dst *[]string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = strings.Fields(v)
+	}
+}
+
+func setBool(dst *bool, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func setInt(dst *int, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func setDuration(dst *time.Duration, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = d
+	return nil
+}
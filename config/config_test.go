@@ -0,0 +1,166 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns the defaults completed with the settings that have none
+func validConfig() *Config {
+	cfg := Default()
+	cfg.JWT.SecretKey = strings.Repeat("k", MinSecretKeyLength)
+	cfg.WeChat.Enabled = true
+	cfg.WeChat.AppID = "wx1111111111111111"
+	cfg.WeChat.AppSecret = "secret"
+	return cfg
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"short secret key", func(c *Config) { c.JWT.SecretKey = "short" }, []string{"jwt.secret_key must be at least 32 characters"}},
+		{"unsupported driver", func(c *Config) { c.Storage.Driver = "mongo" }, []string{`storage.driver "mongo" is not supported`}},
+		{"SQL without DSN", func(c *Config) { c.Storage.Driver = StorageDriverSQLite }, []string{"storage.dsn is required for sqlite"}},
+		{"memory without Redis", func(c *Config) {
+			c.Storage.Driver = StorageDriverMemory
+			c.Redis.Addr = ""
+		}, nil},
+		{"Redis without address", func(c *Config) { c.Redis.Addr = "" }, []string{"redis.addr is required"}},
+		{"access token outlives refresh token", func(c *Config) { c.JWT.AccessTokenTTL = c.JWT.RefreshTokenTTL }, []string{"jwt.access_token_ttl must be shorter than jwt.refresh_token_ttl"}},
+		{"relative proxy URL", func(c *Config) { c.Server.ProxyURL = "/api" }, []string{`server.proxy_url "/api" must be an absolute URL`}},
+		{"bad port", func(c *Config) { c.Server.Port = "http" }, []string{`server.port "http" is not a valid port`}},
+		{"scope with whitespace", func(c *Config) { c.JWT.Scopes = []string{"house read"} }, []string{"jwt.scopes"}},
+		{"WeChat without credentials", func(c *Config) {
+			c.WeChat.AppID = ""
+			c.WeChat.AppSecret = ""
+		}, []string{"wechat.app_id or wechat.apps is required when wechat is enabled"}},
+		{"WeChat disabled without credentials", func(c *Config) {
+			c.WeChat = Default().WeChat
+		}, nil},
+		{"WeChat without secret", func(c *Config) { c.WeChat.AppSecret = "" }, []string{"wechat.app_secret is required"}},
+		{"Official Account without return URLs", func(c *Config) {
+			c.WeChat.Apps = map[string]WeChatAppConfig{"h5": {
+				Type:        WeChatAppOfficialAccount,
+				AppID:       "wx2222222222222222",
+				AppSecret:   "secret",
+				RedirectURL: "https://auth.example.com/wechat/oauth/callback",
+			}}
+		}, []string{"wechat.apps.h5.return_urls is required"}},
+		{"return URL with a query", func(c *Config) {
+			c.WeChat.Apps = map[string]WeChatAppConfig{"h5": {
+				Type:        WeChatAppOfficialAccount,
+				AppID:       "wx2222222222222222",
+				AppSecret:   "secret",
+				RedirectURL: "https://auth.example.com/wechat/oauth/callback",
+				ReturnURLs:  []string{"https://h5.example.com/login?x=1"},
+			}}
+		}, []string{"cannot have a query or fragment"}},
+		{"every problem at once", func(c *Config) {
+			c.JWT.SecretKey = ""
+			c.Server.Port = ""
+			c.OAuth.CodeTTL = -time.Second
+		}, []string{"jwt.secret_key", "server.port is required", "oauth.code_ttl must be positive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+storage:
+  driver: memory
+jwt:
+  access_token_ttl: 5m
+`)
+	t.Setenv("JWT_ACCESS_TOKEN_TTL", "10m")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if cfg.Storage.Driver != StorageDriverMemory {
+		t.Errorf("storage.driver = %q, want it from the file", cfg.Storage.Driver)
+	}
+	if cfg.JWT.AccessTokenTTL != 10*time.Minute {
+		t.Errorf("jwt.access_token_ttl = %v, want it from the environment", cfg.JWT.AccessTokenTTL)
+	}
+	if cfg.JWT.RefreshTokenTTL != Default().JWT.RefreshTokenTTL {
+		t.Errorf("jwt.refresh_token_ttl = %v, want the default", cfg.JWT.RefreshTokenTTL)
+	}
+}
+
+func TestLoadEmptyFile(t *testing.T) {
+	cfg, err := Load(writeConfig(t, ""))
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if cfg.Server.Port != Default().Server.Port {
+		t.Errorf("server.port = %q, want the default", cfg.Server.Port)
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	path := writeConfig(t, `
+redis:
+  adress: localhost:6379
+jwt:
+  secret_key: short
+sever:
+  port: "9000"
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil, want the unknown keys")
+	}
+	for _, want := range []string{"adress", "sever", "jwt.secret_key must be at least"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadInvalidYAML(t *testing.T) {
+	if _, err := Load(writeConfig(t, "redis: [")); err == nil {
+		t.Error("Load() of invalid YAML succeeded")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openDB opens and pings the SQL database used by the sqlite and postgres storage drivers
+func openDB(cfg config.StorageConfig) (*sql.DB, error) {
+	driverName := "postgres"
+	if cfg.Driver == config.StorageDriverSQLite {
+		driverName = "sqlite3"
+	}
+
+	db, err := sql.Open(driverName, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Driver == config.StorageDriverSQLite {
+		// SQLite allows a single writer; serialize access instead of failing with "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/gin-gonic/gin"
+)
+
+// GrantRoleRequest names the role to grant
+type GrantRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// GetUser returns any user by ID
+func (h *AuthHandler) GetUser(c *gin.Context) {
+	user, err := h.userStore.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// GrantRole gives a user a role. It takes effect when the user's access
+// token is next refreshed.
+func (h *AuthHandler) GrantRole(c *gin.Context) {
+	var req GrantRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.IsValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role"})
+		return
+	}
+
+	user, err := h.userStore.GrantRole(c.Request.Context(), c.Param("id"), req.Role)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to grant role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles(user)})
+}
+
+// RevokeRole takes a role from a user. Access tokens carry the roles, so the
+// user's tokens are revoked and the next refresh gets tokens without it.
+func (h *AuthHandler) RevokeRole(c *gin.Context) {
+	role := c.Param("role")
+	if !models.IsValidRole(role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role"})
+		return
+	}
+
+	// Admins cannot lock themselves out; another admin has to do it
+	if role == models.RoleAdmin && c.Param("id") == c.GetString("userID") {
+		c.JSON(http.StatusConflict, gin.H{"error": "cannot revoke your own admin role"})
+		return
+	}
+
+	user, err := h.userStore.RevokeRole(c.Request.Context(), c.Param("id"), role)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke role"})
+		return
+	}
+	if err := h.revokeAccessTokens(c.Request.Context(), user.ID, c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles(user)})
+}
+
+// BanUser stops a user from logging in or refreshing tokens and logs them
+// out everywhere
+func (h *AuthHandler) BanUser(c *gin.Context) {
+	// Admins cannot lock themselves out; another admin has to do it
+	if c.Param("id") == c.GetString("userID") {
+		c.JSON(http.StatusConflict, gin.H{"error": "cannot ban yourself"})
+		return
+	}
+
+	user, ok := h.setBanned(c, true)
+	if !ok {
+		return
+	}
+
+	if _, err := h.logOutEverywhere(c.Request.Context(), user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user banned"})
+}
+
+// UnbanUser lets a banned user log in again
+func (h *AuthHandler) UnbanUser(c *gin.Context) {
+	if _, ok := h.setBanned(c, false); !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user unbanned"})
+}
+
+// setBanned bans or unbans the user named in the path, reporting errors to
+// the client
+func (h *AuthHandler) setBanned(c *gin.Context, banned bool) (*models.User, bool) {
+	user, err := h.userStore.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return nil, false
+	}
+
+	user.Banned = banned
+	if err := h.userStore.Update(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// roles returns the user's roles, never nil so it is sent as a JSON array
+func roles(user *models.User) []string {
+	if user.Roles == nil {
+		return []string{}
+	}
+	return user.Roles
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAPIKeyRequest describes a new API key
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+	// Scope is a space separated subset of the owner's scopes. It defaults
+	// to all of them.
+	Scope string `json:"scope"`
+}
+
+// APIKeyResponse carries a new API key together with its record. The key is
+// only ever shown here.
+type APIKeyResponse struct {
+	Key string `json:"key"`
+	models.APIKey
+}
+
+// CreateServiceAccountRequest names a new service account
+type CreateServiceAccountRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=30"`
+}
+
+// ListAPIKeys returns the current user's API keys
+func (h *AuthHandler) ListAPIKeys(c *gin.Context) {
+	h.listAPIKeys(c, c.GetString("userID"))
+}
+
+// CreateAPIKey creates an API key for the current user
+func (h *AuthHandler) CreateAPIKey(c *gin.Context) {
+	h.createAPIKey(c, c.GetString("userID"))
+}
+
+// RevokeAPIKey revokes one of the current user's API keys
+func (h *AuthHandler) RevokeAPIKey(c *gin.Context) {
+	h.revokeAPIKey(c, c.GetString("userID"), c.Param("id"))
+}
+
+// ListUserAPIKeys returns any user's API keys
+func (h *AuthHandler) ListUserAPIKeys(c *gin.Context) {
+	h.listAPIKeys(c, c.Param("id"))
+}
+
+// CreateUserAPIKey creates an API key for any user, typically a service account
+func (h *AuthHandler) CreateUserAPIKey(c *gin.Context) {
+	h.createAPIKey(c, c.Param("id"))
+}
+
+// RevokeUserAPIKey revokes any user's API key
+func (h *AuthHandler) RevokeUserAPIKey(c *gin.Context) {
+	h.revokeAPIKey(c, c.Param("id"), c.Param("key_id"))
+}
+
+// CreateServiceAccount creates a user for a machine client. It has no
+// password or linked identities, so it can only authenticate with API keys.
+func (h *AuthHandler) CreateServiceAccount(c *gin.Context) {
+	var req CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if models.IsReservedUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reservedUsernameError})
+		return
+	}
+
+	user := &models.User{Username: req.Username}
+	if err := h.userStore.Create(c.Request.Context(), user); err != nil {
+		if errors.Is(err, models.ErrUsernameTaken) || errors.Is(err, models.ErrUserExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, newUserResponse(user))
+}
+
+// listAPIKeys returns the API keys of userID, which may be a legacy ID
+func (h *AuthHandler) listAPIKeys(c *gin.Context, userID string) {
+	userID, err := h.resolveUserID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	apiKeys, err := h.apiKeys.ListByUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": apiKeys})
+}
+
+// createAPIKey creates an API key for userID, which may be a legacy ID,
+// granting the requested scopes, which must be ones the user is entitled to
+func (h *AuthHandler) createAPIKey(c *gin.Context, userID string) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.userStore.GetByID(c.Request.Context(), userID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	entitled := h.jwtManager.ScopesFor(user.Roles)
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = entitled
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(entitled, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scope " + scope + " is not granted to this user"})
+			return
+		}
+	}
+	scopes = slices.Compact(slices.Sorted(slices.Values(scopes)))
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	key, apiKey, err := h.apiKeys.Create(c.Request.Context(), user.ID, req.Name, scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, APIKeyResponse{Key: key, APIKey: *apiKey})
+}
+
+// revokeAPIKey revokes the API key id of userID, which may be a legacy ID
+func (h *AuthHandler) revokeAPIKey(c *gin.Context, userID, id string) {
+	userID, err := h.resolveUserID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Only allow revoking the user's own keys
+	apiKey, err := h.apiKeys.Get(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get API key"})
+		return
+	}
+	if apiKey.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	if err := h.apiKeys.Delete(c.Request.Context(), userID, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -1,32 +1,50 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/LIUHUANUCAS/auth/config"
 	"github.com/LIUHUANUCAS/auth/models"
 	"github.com/LIUHUANUCAS/auth/utils"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // AuthHandler handles authentication requests
 type AuthHandler struct {
-	userStore     *models.UserStore
-	jwtManager    *utils.JWTManager
-	wechatManager *utils.WeChatManager
-	redisClient   *redis.Client
+	userStore         models.UserRepository
+	refreshTokenStore *models.RefreshTokenStore
+	sessionStore      *models.SessionStore
+	denylist          *models.TokenDenylist
+	jwtManager        *utils.JWTManager
+	wechatManager     *utils.WeChatManager
+	wechatSessionKeys *models.WeChatSessionKeyStore
+	wechatOAuthStates *models.WeChatOAuthStateStore
+	apiKeys           *models.APIKeyStore
+	oauthClients      *models.OAuthClientStore
+	oauthCodes        *models.OAuthCodeStore
 }
 
 // NewAuthHandler creates a new AuthHandler
-func NewAuthHandler(userStore *models.UserStore, jwtManager *utils.JWTManager, wechatManager *utils.WeChatManager, redisClient *redis.Client) *AuthHandler {
+func NewAuthHandler(userStore models.UserRepository, refreshTokenStore *models.RefreshTokenStore, sessionStore *models.SessionStore, denylist *models.TokenDenylist, jwtManager *utils.JWTManager, wechatManager *utils.WeChatManager, wechatSessionKeys *models.WeChatSessionKeyStore, wechatOAuthStates *models.WeChatOAuthStateStore, apiKeys *models.APIKeyStore, oauthClients *models.OAuthClientStore, oauthCodes *models.OAuthCodeStore) *AuthHandler {
 	return &AuthHandler{
-		userStore:     userStore,
-		jwtManager:    jwtManager,
-		wechatManager: wechatManager,
-		redisClient:   redisClient,
+		userStore:         userStore,
+		refreshTokenStore: refreshTokenStore,
+		sessionStore:      sessionStore,
+		denylist:          denylist,
+		jwtManager:        jwtManager,
+		wechatManager:     wechatManager,
+		wechatSessionKeys: wechatSessionKeys,
+		wechatOAuthStates: wechatOAuthStates,
+		apiKeys:           apiKeys,
+		oauthClients:      oauthClients,
+		oauthCodes:        oauthCodes,
 	}
 }
 
@@ -48,8 +66,64 @@ type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int64  `json:"expires_in"` // seconds
+	Scope        string `json:"scope"`
+
+	// sessionID is the session the tokens belong to
+	sessionID string
+}
+
+// UserResponse is a user as returned by the API, without the password hash
+type UserResponse struct {
+	ID         string            `json:"id"`
+	Username   string            `json:"username"`
+	Email      string            `json:"email"`
+	OpenID     string            `json:"open_id,omitempty"`
+	Phone      string            `json:"phone,omitempty"`
+	Nickname   string            `json:"nickname,omitempty"`
+	AvatarURL  string            `json:"avatar_url,omitempty"`
+	Roles      []string          `json:"roles"`
+	Banned     bool              `json:"banned"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Identities []models.Identity `json:"identities"`
+}
+
+// newUserResponse returns the fields of user that may be shown to clients
+func newUserResponse(user *models.User) UserResponse {
+	return UserResponse{
+		ID:         user.ID,
+		Username:   user.Username,
+		Email:      user.Email,
+		OpenID:     user.OpenID,
+		Phone:      user.Phone,
+		Nickname:   user.Nickname,
+		AvatarURL:  user.AvatarURL,
+		Roles:      roles(user),
+		Banned:     user.Banned,
+		CreatedAt:  user.CreatedAt,
+		UpdatedAt:  user.UpdatedAt,
+		Identities: identitiesOf(user),
+	}
+}
+
+// ChangePasswordRequest represents a password change request
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
 }
 
+// reservedUsernameError explains why a username cannot be registered
+const reservedUsernameError = "usernames starting with " + models.WeChatUsernamePrefix + " or " + models.PhoneUsernamePrefix + " are reserved"
+
+// errUserBanned is returned by issueTokens for banned users
+var errUserBanned = errors.New("user is banned")
+
+// Errors of rotateRefreshToken for tokens that cannot be refreshed
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenRevoked = errors.New("refresh token has been revoked")
+)
+
 // RefreshRequest represents a refresh token request
 type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
@@ -58,6 +132,9 @@ type RefreshRequest struct {
 // WeChatLoginRequest represents a WeChat Mini Program login request
 type WeChatLoginRequest struct {
 	Code string `json:"code" binding:"required"`
+	// App is the Mini Program the code comes from, unless the path names it.
+	// It defaults to the default app.
+	App string `json:"app"`
 }
 
 // Register handles user registration
@@ -68,10 +145,8 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	// Check if username already exists
-	_, err := h.userStore.GetByUsername(c.Request.Context(), req.Username)
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
+	if models.IsReservedUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reservedUsernameError})
 		return
 	}
 
@@ -83,15 +158,23 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	}
 
 	// Create the user
+	// The store generates an opaque ID
 	user := &models.User{
-		ID:       req.Username, // Using username as ID for simplicity
 		Username: req.Username,
 		Password: string(hashedPassword),
 		Email:    req.Email,
 	}
 
+	// The store rejects duplicates atomically, so concurrent registrations cannot both succeed
 	if err := h.userStore.Create(c.Request.Context(), user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
+		switch {
+		case errors.Is(err, models.ErrUsernameTaken), errors.Is(err, models.ErrUserExists):
+			c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
+		case errors.Is(err, models.ErrEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
+		}
 		return
 	}
 
@@ -123,32 +206,14 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	}
 
 	// Generate tokens
-	accessToken, err := h.jwtManager.GenerateAccessToken(user.ID)
+	tokenResp, err := h.issueTokens(c, user, utils.Claims{})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
-		return
-	}
-
-	refreshToken, err := h.jwtManager.GenerateRefreshToken(user.ID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
-		return
-	}
-
-	// Store refresh token in Redis
-	refreshTokenKey := "refresh_token:" + refreshToken
-	err = h.redisClient.Set(c.Request.Context(), refreshTokenKey, user.ID, 7*24*time.Hour).Err()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
+		tokenError(c, err)
 		return
 	}
 
 	// Return the tokens
-	c.JSON(http.StatusOK, TokenResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    15 * 60, // 15 minutes in seconds
-	})
+	c.JSON(http.StatusOK, tokenResp)
 }
 
 // RefreshToken handles token refresh
@@ -165,33 +230,32 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
 		return
 	}
-
-	// Check if the refresh token exists in Redis
-	refreshTokenKey := "refresh_token:" + req.RefreshToken
-	userID, err := h.redisClient.Get(c.Request.Context(), refreshTokenKey).Result()
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token has been revoked"})
+	// Tokens of third party apps are refreshed by the app at /oauth/token,
+	// where it authenticates
+	if claims.ClientID != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh tokens issued to OAuth clients must be refreshed at /oauth/token"})
 		return
 	}
 
-	// Verify the user ID matches
-	if userID != claims.UserID {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+	user, err := h.rotateRefreshToken(c.Request.Context(), req.RefreshToken, claims)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Generate a new access token
-	accessToken, err := h.jwtManager.GenerateAccessToken(claims.UserID)
+	// Issue a new token pair in the same family, for the same app and client
+	tokenResp, err := h.issueTokens(c, user, *claims)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		tokenError(c, err)
 		return
 	}
 
-	// Return the new access token
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
-		"expires_in":   15 * 60, // 15 minutes in seconds
-	})
+	// Return the new tokens
+	c.JSON(http.StatusOK, tokenResp)
 }
 
 // Logout handles user logout
@@ -202,13 +266,31 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 		return
 	}
 
-	// Delete the refresh token from Redis
-	refreshTokenKey := "refresh_token:" + req.RefreshToken
-	err := h.redisClient.Del(c.Request.Context(), refreshTokenKey).Err()
-	if err != nil {
+	// Delete the refresh token and, when it belongs to one, its session
+	if err := h.refreshTokenStore.Delete(c.Request.Context(), req.RefreshToken); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
 		return
 	}
+	if claims, err := h.jwtManager.ValidateRefreshToken(req.RefreshToken); err == nil && claims.FamilyID != "" {
+		userID, err := h.resolveUserID(c.Request.Context(), claims.UserID)
+		if err == nil {
+			err = h.revokeSession(c.Request.Context(), userID, claims.FamilyID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+			return
+		}
+	}
+
+	// Revoke the access token too when the client sends it
+	if tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if claims, err := h.jwtManager.ValidateAccessToken(tokenString); err == nil && claims.ID != "" {
+			if err := h.denylist.Revoke(c.Request.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+				return
+			}
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
 }
@@ -229,8 +311,53 @@ func (h *AuthHandler) Me(c *gin.Context) {
 		return
 	}
 
-	// Return the user (password will be omitted due to the json tag)
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// ChangePassword changes the current user's password and logs them out
+// everywhere, so a stolen password or token stops working
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.userStore.GetByID(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Users without a password, such as WeChat only ones, never match
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid current password"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+	user.Password = string(hashedPassword)
+	if err := h.userStore.Update(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
+		return
+	}
+
+	if _, err := h.logOutEverywhere(c.Request.Context(), user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password changed, log in again"})
+}
+
+// JWKS publishes the public token verification keys
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.jwtManager.JWKS())
 }
 
 // WeChatLogin handles WeChat Mini Program login
@@ -241,46 +368,191 @@ func (h *AuthHandler) WeChatLogin(c *gin.Context) {
 		return
 	}
 
+	app, ok := h.wechatApp(c, req.App, config.WeChatAppMiniProgram)
+	if !ok {
+		return
+	}
+
 	// Exchange code for session info (including OpenID)
-	sessionInfo, err := h.wechatManager.Code2Session(req.Code)
+	sessionInfo, err := h.wechatManager.Code2Session(c.Request.Context(), app, req.Code)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to exchange code: %v", err)})
+		wechatError(c, "exchange code", err)
 		return
 	}
 
-	// Get or create user with OpenID
-	user, err := h.userStore.CreateWeChatUser(c.Request.Context(), sessionInfo.OpenID)
+	// Get or create the user, by UnionID when the app is bound to an Open Platform account
+	provider := models.WeChatIdentityProvider(app)
+	user, err := models.FindOrCreateWeChatUser(c.Request.Context(), h.userStore, provider, sessionInfo.OpenID, sessionInfo.UnionID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to create user: %v", err)})
 		return
 	}
 
+	// Keep the session key server-side for decrypting the user's data later
+	if err := h.wechatSessionKeys.Store(c.Request.Context(), app, user.ID, sessionInfo.SessionKey, h.wechatManager.SessionKeyTTL()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store WeChat session"})
+		return
+	}
+
 	// Generate tokens
-	accessToken, err := h.jwtManager.GenerateAccessToken(user.ID)
+	tokenResp, err := h.issueTokens(c, user, utils.Claims{WeChatApp: app})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		tokenError(c, err)
 		return
 	}
 
-	refreshToken, err := h.jwtManager.GenerateRefreshToken(user.ID)
+	// Return the tokens
+	c.JSON(http.StatusOK, tokenResp)
+}
+
+// issueTokens generates an access and refresh token pair for the user and
+// stores the refresh token as the active token of grant.FamilyID. An empty
+// family starts a new one and registers it as a session of the user. The
+// tokens are for grant.WeChatApp and, when set, the OAuth2 client
+// grant.ClientID, whose tokens carry no roles and at most the scopes the user
+// consented to in grant.Scope. Banned users get errUserBanned.
+func (h *AuthHandler) issueTokens(c *gin.Context, user *models.User, grant utils.Claims) (*TokenResponse, error) {
+	if user.Banned {
+		return nil, errUserBanned
+	}
+
+	ctx := c.Request.Context()
+	userID := user.ID
+	familyID := grant.FamilyID
+
+	roles := user.Roles
+	scopes := h.jwtManager.ScopesFor(user.Roles)
+	if grant.ClientID != "" {
+		roles = nil
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return !grant.HasScope(scope)
+		})
+	}
+	scope := strings.Join(scopes, " ")
+
+	var err error
+	newSession := familyID == ""
+	if newSession {
+		if familyID, err = utils.NewRandomID(); err != nil {
+			return nil, errors.New("failed to generate refresh token")
+		}
+	} else {
+		err = h.sessionStore.Touch(ctx, familyID, h.jwtManager.RefreshTokenTTL())
+		if errors.Is(err, models.ErrSessionNotFound) {
+			// Family issued before sessions were tracked
+			newSession = true
+		} else if err != nil {
+			return nil, errors.New("failed to update session")
+		}
+	}
+
+	if newSession {
+		session := &models.Session{
+			ID:        familyID,
+			UserID:    userID,
+			UserAgent: c.Request.UserAgent(),
+			IP:        c.ClientIP(),
+			ClientID:  grant.ClientID,
+		}
+		if err := h.sessionStore.Create(ctx, session, h.jwtManager.RefreshTokenTTL()); err != nil {
+			return nil, errors.New("failed to create session")
+		}
+	}
+
+	accessToken, err := h.jwtManager.GenerateAccessToken(utils.Claims{
+		UserID:    userID,
+		FamilyID:  familyID,
+		WeChatApp: grant.WeChatApp,
+		Roles:     roles,
+		Scope:     scope,
+		ClientID:  grant.ClientID,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
-		return
+		return nil, errors.New("failed to generate access token")
+	}
+
+	refreshToken, err := h.jwtManager.GenerateRefreshToken(utils.Claims{
+		UserID:    userID,
+		FamilyID:  familyID,
+		WeChatApp: grant.WeChatApp,
+		Scope:     grant.Scope,
+		ClientID:  grant.ClientID,
+	})
+	if err != nil {
+		return nil, errors.New("failed to generate refresh token")
 	}
 
 	// Store refresh token in Redis
-	refreshTokenKey := "refresh_token:" + refreshToken
-	err = h.redisClient.Set(c.Request.Context(), refreshTokenKey, user.ID, 7*24*time.Hour).Err()
+	err = h.refreshTokenStore.Store(ctx, refreshToken, userID, familyID, h.jwtManager.RefreshTokenTTL())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
-		return
+		return nil, errors.New("failed to store refresh token")
 	}
-	tokenResp := TokenResponse{
+
+	return &TokenResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
-		ExpiresIn:    15 * 60, // 15 minutes in seconds
+		ExpiresIn:    int64(h.jwtManager.AccessTokenTTL().Seconds()),
+		Scope:        scope,
+		sessionID:    familyID,
+	}, nil
+}
+
+// rotateRefreshToken consumes a validated refresh token so it can only be used
+// once and returns its user. Reuse of a rotated token means it may have been
+// stolen, so the whole family is revoked and errRefreshTokenRevoked returned.
+// Tokens of deleted users or OAuth2 clients give errInvalidRefreshToken.
+func (h *AuthHandler) rotateRefreshToken(ctx context.Context, refreshToken string, claims *utils.Claims) (*models.User, error) {
+	userID, err := h.refreshTokenStore.Consume(ctx, refreshToken)
+	if err != nil {
+		if errors.Is(err, models.ErrRefreshTokenNotFound) {
+			// A validly signed token that is no longer active has either been
+			// logged out or already rotated
+			if claims.FamilyID != "" {
+				userID, err := h.resolveUserID(ctx, claims.UserID)
+				if err == nil {
+					err = h.revokeSession(ctx, userID, claims.FamilyID)
+				}
+				if err != nil {
+					return nil, errors.New("failed to revoke refresh token")
+				}
+			}
+			return nil, errRefreshTokenRevoked
+		}
+		return nil, errors.New("failed to check refresh token")
 	}
-	// fmt.Println("WeChat login successful, user ID:", tokenResp)
-	// Return the tokens
-	c.JSON(http.StatusOK, tokenResp)
+
+	// Verify the user ID matches
+	if userID != claims.UserID {
+		return nil, errInvalidRefreshToken
+	}
+
+	// Look up the user; this also resolves legacy IDs to the current one
+	user, err := h.userStore.GetByID(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, errors.New("failed to get user")
+	}
+
+	// Tokens issued to an OAuth2 client stop refreshing once it is removed
+	if claims.ClientID != "" {
+		if _, err := h.oauthClients.Get(ctx, claims.ClientID); err != nil {
+			if errors.Is(err, models.ErrOAuthClientNotFound) {
+				return nil, errInvalidRefreshToken
+			}
+			return nil, errors.New("failed to get OAuth client")
+		}
+	}
+
+	return user, nil
+}
+
+// tokenError reports an error from issueTokens
+func tokenError(c *gin.Context, err error) {
+	if errors.Is(err, errUserBanned) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/middleware"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestRouter serves the password login and account routes from an
+// in-process Redis
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	router, _ := newTestRouterWithUsers(t)
+	return router
+}
+
+// newTestRouterWithUsers is newTestRouter that also returns its user store
+func newTestRouterWithUsers(t *testing.T) (*gin.Engine, *models.RedisUserStore) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	cfg := config.Default()
+	cfg.JWT.SecretKey = "0123456789abcdef0123456789abcdef"
+	cfg.JWT.DenylistCacheTTL = 0
+	jwtManager, err := utils.NewJWTManager(&cfg.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := models.NewRedisUserStore(redisClient)
+	denylist := models.NewTokenDenylist(redisClient, cfg.JWT.DenylistCacheTTL)
+	apiKeys := models.NewAPIKeyStore(redisClient)
+	h := NewAuthHandler(
+		userStore,
+		models.NewRefreshTokenStore(redisClient),
+		models.NewSessionStore(redisClient),
+		denylist,
+		jwtManager,
+		utils.NewWeChatManager(&cfg.WeChat, models.NewWeChatAccessTokenStore(redisClient)),
+		models.NewWeChatSessionKeyStore(redisClient),
+		models.NewWeChatOAuthStateStore(redisClient),
+		apiKeys,
+		models.NewOAuthClientStore(redisClient),
+		models.NewOAuthCodeStore(redisClient, cfg.OAuth.CodeTTL),
+	)
+	authMiddleware := middleware.NewAuthMiddleware(jwtManager, denylist, apiKeys, userStore)
+
+	router := gin.New()
+	router.POST("/register", h.Register)
+	router.POST("/login", h.Login)
+	router.POST("/refresh", h.RefreshToken)
+	router.POST("/logout", h.Logout)
+	router.GET("/me", authMiddleware.AuthRequired(), h.Me)
+	router.POST("/token/downscope", authMiddleware.AuthRequired(), authMiddleware.RequireUser(), h.DownscopeToken)
+	account := router.Group("/me", authMiddleware.AuthRequired(), authMiddleware.RequireSession())
+	account.POST("/password", h.ChangePassword)
+	account.GET("/sessions", h.ListSessions)
+	account.DELETE("/sessions/:id", h.RevokeSession)
+	account.POST("/sessions/revoke-all", h.RevokeAllSessions)
+	account.GET("/api-keys", h.ListAPIKeys)
+	account.POST("/api-keys", h.CreateAPIKey)
+	account.DELETE("/api-keys/:id", h.RevokeAPIKey)
+	return router, userStore
+}
+
+// serve sends a JSON request to router and decodes the JSON response
+func serve(t *testing.T, router *gin.Engine, method, path string, body any, accessToken string) (int, map[string]any) {
+	t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: invalid JSON response %q", method, path, w.Body.String())
+	}
+	return w.Code, resp
+}
+
+func TestRegisterLoginMe(t *testing.T) {
+	router := newTestRouter(t)
+	alice := map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}
+
+	status, resp := serve(t, router, http.MethodPost, "/register", alice, "")
+	if status != http.StatusCreated {
+		t.Fatalf("register: status %d, %v", status, resp)
+	}
+	userID := resp["user_id"]
+
+	status, _ = serve(t, router, http.MethodPost, "/register", alice, "")
+	if status != http.StatusConflict {
+		t.Errorf("register taken username: status %d, want %d", status, http.StatusConflict)
+	}
+	reserved := map[string]any{"username": models.PhoneUsernamePrefix + "13800138000", "password": "secret1", "email": "p@example.com"}
+	status, _ = serve(t, router, http.MethodPost, "/register", reserved, "")
+	if status != http.StatusBadRequest {
+		t.Errorf("register reserved username: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	status, _ = serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "wrong-password"}, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, resp = serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	if status != http.StatusOK {
+		t.Fatalf("login: status %d, %v", status, resp)
+	}
+	accessToken, _ := resp["access_token"].(string)
+
+	status, _ = serve(t, router, http.MethodGet, "/me", nil, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("me without token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, resp = serve(t, router, http.MethodGet, "/me", nil, accessToken)
+	if status != http.StatusOK {
+		t.Fatalf("me: status %d, %v", status, resp)
+	}
+	if resp["id"] != userID || resp["username"] != "alice" || resp["email"] != "alice@example.com" {
+		t.Errorf("me = %v, want alice with ID %v", resp, userID)
+	}
+	if _, ok := resp["password"]; ok {
+		t.Error("me exposes the password hash")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	router := newTestRouter(t)
+	serve(t, router, http.MethodPost, "/register", map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}, "")
+	_, login := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+
+	status, refreshed := serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": login["refresh_token"]}, "")
+	if status != http.StatusOK {
+		t.Fatalf("refresh: status %d, %v", status, refreshed)
+	}
+	if refreshed["refresh_token"] == login["refresh_token"] {
+		t.Error("refresh returned the same refresh token")
+	}
+
+	// Reusing the rotated token revokes the whole session
+	status, _ = serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": login["refresh_token"]}, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, _ = serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": refreshed["refresh_token"]}, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("refresh token of a revoked session: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	accessToken, _ := refreshed["access_token"].(string)
+	status, _ = serve(t, router, http.MethodGet, "/me", nil, accessToken)
+	if status != http.StatusUnauthorized {
+		t.Errorf("access token of a revoked session: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestChangePasswordRevokesTokens(t *testing.T) {
+	router := newTestRouter(t)
+	serve(t, router, http.MethodPost, "/register", map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}, "")
+	_, login := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	accessToken, _ := login["access_token"].(string)
+
+	change := map[string]any{"current_password": "secret1", "new_password": "secret2"}
+	status, resp := serve(t, router, http.MethodPost, "/me/password", change, accessToken)
+	if status != http.StatusOK {
+		t.Fatalf("change password: status %d, %v", status, resp)
+	}
+	status, _ = serve(t, router, http.MethodGet, "/me", nil, accessToken)
+	if status != http.StatusUnauthorized {
+		t.Errorf("access token from before the change: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, _ = serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": login["refresh_token"]}, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("refresh token from before the change: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, _ = serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with the old password: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Logging in again straight away, within the same second, must work
+	status, login = serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret2"}, "")
+	if status != http.StatusOK {
+		t.Fatalf("login with the new password: status %d, %v", status, login)
+	}
+	accessToken, _ = login["access_token"].(string)
+	status, resp = serve(t, router, http.MethodGet, "/me", nil, accessToken)
+	if status != http.StatusOK {
+		t.Errorf("access token from the new login: status %d, %v", status, resp)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	router := newTestRouter(t)
+	serve(t, router, http.MethodPost, "/register", map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}, "")
+	_, phone := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	_, laptop := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	laptopToken, _ := laptop["access_token"].(string)
+	phoneToken, _ := phone["access_token"].(string)
+
+	status, resp := serve(t, router, http.MethodPost, "/me/sessions/revoke-all", nil, laptopToken)
+	if status != http.StatusOK {
+		t.Fatalf("revoke-all: status %d, %v", status, resp)
+	}
+	for name, token := range map[string]string{"laptop": laptopToken, "phone": phoneToken} {
+		if status, _ := serve(t, router, http.MethodGet, "/me", nil, token); status != http.StatusUnauthorized {
+			t.Errorf("%s access token: status %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": phone["refresh_token"]}, ""); status != http.StatusUnauthorized {
+		t.Errorf("phone refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	_, login := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	token, _ := login["access_token"].(string)
+	if status, resp := serve(t, router, http.MethodGet, "/me", nil, token); status != http.StatusOK {
+		t.Errorf("access token from the next login: status %d, %v", status, resp)
+	}
+}
+
+func TestDownscopeToken(t *testing.T) {
+	router := newTestRouter(t)
+	serve(t, router, http.MethodPost, "/register", map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}, "")
+	_, login := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	accessToken, _ := login["access_token"].(string)
+
+	status, resp := serve(t, router, http.MethodPost, "/token/downscope", map[string]any{"scope": "admin:write"}, accessToken)
+	if status != http.StatusBadRequest {
+		t.Errorf("down-scoping to a scope not granted: status %d, %v", status, resp)
+	}
+	status, resp = serve(t, router, http.MethodPost, "/token/downscope", map[string]any{"scope": "fortune:read"}, accessToken)
+	if status != http.StatusOK || resp["scope"] != "fortune:read" {
+		t.Fatalf("down-scoping: status %d, %v", status, resp)
+	}
+	narrowToken, _ := resp["access_token"].(string)
+
+	if status, resp := serve(t, router, http.MethodGet, "/me", nil, narrowToken); status != http.StatusOK {
+		t.Errorf("GET /me with the down-scoped token: status %d, %v", status, resp)
+	}
+	change := map[string]any{"current_password": "secret1", "new_password": "secret2"}
+	if status, resp := serve(t, router, http.MethodPost, "/me/password", change, narrowToken); status != http.StatusForbidden {
+		t.Errorf("changing the password with the down-scoped token: status %d, %v", status, resp)
+	}
+
+	// Logging the session out revokes the down-scoped token with it
+	if status, resp := serve(t, router, http.MethodPost, "/logout", map[string]any{"refresh_token": login["refresh_token"]}, ""); status != http.StatusOK {
+		t.Fatalf("logout: status %d, %v", status, resp)
+	}
+	if status, _ := serve(t, router, http.MethodGet, "/me", nil, narrowToken); status != http.StatusUnauthorized {
+		t.Errorf("down-scoped token after logout: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeysOfMigratedUser(t *testing.T) {
+	ctx := context.Background()
+	router, users := newTestRouterWithUsers(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(ctx, &models.User{ID: "alice", Username: "alice", Password: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+	_, login := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	accessToken, _ := login["access_token"].(string)
+	if _, err := users.MigrateLegacyIDs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token still carries the legacy ID
+	status, resp := serve(t, router, http.MethodPost, "/me/api-keys", map[string]any{"name": "nightly"}, accessToken)
+	if status != http.StatusCreated {
+		t.Fatalf("create: status %d, %v", status, resp)
+	}
+	keyID, _ := resp["id"].(string)
+	status, resp = serve(t, router, http.MethodGet, "/me/api-keys", nil, accessToken)
+	if keys, _ := resp["api_keys"].([]any); status != http.StatusOK || len(keys) != 1 {
+		t.Errorf("list: status %d, %v, want the new key", status, resp)
+	}
+	if status, resp := serve(t, router, http.MethodDelete, "/me/api-keys/"+keyID, nil, accessToken); status != http.StatusOK {
+		t.Errorf("revoke: status %d, %v", status, resp)
+	}
+	status, resp = serve(t, router, http.MethodGet, "/me/api-keys", nil, accessToken)
+	if keys, _ := resp["api_keys"].([]any); status != http.StatusOK || len(keys) != 0 {
+		t.Errorf("list after revoke: status %d, %v, want no keys", status, resp)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	router := newTestRouter(t)
+	serve(t, router, http.MethodPost, "/register", map[string]any{"username": "alice", "password": "secret1", "email": "alice@example.com"}, "")
+	_, phone := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	_, laptop := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	_, tablet := serve(t, router, http.MethodPost, "/login", map[string]any{"username": "alice", "password": "secret1"}, "")
+	laptopToken, _ := laptop["access_token"].(string)
+	phoneToken, _ := phone["access_token"].(string)
+
+	sessionIDs := func() []string {
+		t.Helper()
+		status, resp := serve(t, router, http.MethodGet, "/me/sessions", nil, laptopToken)
+		if status != http.StatusOK {
+			t.Fatalf("list sessions: status %d, %v", status, resp)
+		}
+		var ids []string
+		sessions, _ := resp["sessions"].([]any)
+		for _, session := range sessions {
+			session, _ := session.(map[string]any)
+			id, _ := session["id"].(string)
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	ids := sessionIDs()
+	if len(ids) != 3 {
+		t.Fatalf("sessions = %v, want three", ids)
+	}
+
+	// Reusing a rotated refresh token ends its session
+	_, refreshed := serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": tablet["refresh_token"]}, "")
+	serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": tablet["refresh_token"]}, "")
+	if got := sessionIDs(); len(got) != 2 {
+		t.Errorf("sessions after refresh token reuse = %v, want two", got)
+	}
+	if status, _ := serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": refreshed["refresh_token"]}, ""); status != http.StatusUnauthorized {
+		t.Errorf("refresh token of the reused session: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	claims := &utils.Claims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(laptopToken, claims); err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := serve(t, router, http.MethodDelete, "/me/sessions/"+claims.FamilyID, nil, phoneToken); status != http.StatusOK {
+		t.Fatalf("revoke the laptop's session: status %d, %v", status, resp)
+	}
+	if status, _ := serve(t, router, http.MethodGet, "/me", nil, laptopToken); status != http.StatusUnauthorized {
+		t.Errorf("access token of the revoked session: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := serve(t, router, http.MethodPost, "/refresh", map[string]any{"refresh_token": laptop["refresh_token"]}, ""); status != http.StatusUnauthorized {
+		t.Errorf("refresh token of the revoked session: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, resp := serve(t, router, http.MethodGet, "/me", nil, phoneToken); status != http.StatusOK {
+		t.Errorf("access token of the remaining session: status %d, %v", status, resp)
+	}
+	if status, resp := serve(t, router, http.MethodDelete, "/me/sessions/unknown", nil, phoneToken); status != http.StatusNotFound {
+		t.Errorf("revoke unknown session: status %d, %v", status, resp)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ListIdentities returns the identities linked to the current user
+func (h *AuthHandler) ListIdentities(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	user, err := h.userStore.GetByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identitiesOf(user)})
+}
+
+// LinkWeChat attaches the WeChat account behind a wx.login code to the current user
+func (h *AuthHandler) LinkWeChat(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	var req WeChatLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	app, ok := h.wechatApp(c, req.App, config.WeChatAppMiniProgram)
+	if !ok {
+		return
+	}
+
+	// Exchange code for session info (including OpenID)
+	sessionInfo, err := h.wechatManager.Code2Session(c.Request.Context(), app, req.Code)
+	if err != nil {
+		wechatError(c, "exchange code", err)
+		return
+	}
+
+	identity := models.Identity{
+		Provider: models.WeChatIdentityProvider(app),
+		Subject:  sessionInfo.OpenID,
+		UnionID:  sessionInfo.UnionID,
+	}
+	user, err := h.userStore.LinkIdentity(c.Request.Context(), userID, identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrIdentityTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "WeChat account is linked to another user"})
+		case errors.Is(err, models.ErrProviderLinked):
+			c.JSON(http.StatusConflict, gin.H{"error": "a different WeChat account is already linked"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link identity"})
+		}
+		return
+	}
+
+	// Keep the session key server-side for decrypting the user's data later
+	if err := h.wechatSessionKeys.Store(c.Request.Context(), app, user.ID, sessionInfo.SessionKey, h.wechatManager.SessionKeyTTL()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store WeChat session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identitiesOf(user)})
+}
+
+// LinkPhone links the phone number verified by WeChat to the current user,
+// who can then log in with it
+func (h *AuthHandler) LinkPhone(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	var req WeChatPhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	app, ok := h.wechatApp(c, req.App, config.WeChatAppMiniProgram)
+	if !ok {
+		return
+	}
+	phone, ok := h.wechatPhoneNumber(c, app, req.Code)
+	if !ok {
+		return
+	}
+
+	identity := models.Identity{
+		Provider: models.IdentityPhone,
+		Subject:  phone,
+	}
+	user, err := h.userStore.LinkIdentity(c.Request.Context(), userID, identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrIdentityTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "phone number is linked to another user"})
+		case errors.Is(err, models.ErrProviderLinked):
+			c.JSON(http.StatusConflict, gin.H{"error": "a different phone number is already linked"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link identity"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identitiesOf(user)})
+}
+
+// UnlinkIdentity removes one of the current user's identities, unless it is
+// the user's last way to log in
+func (h *AuthHandler) UnlinkIdentity(c *gin.Context) {
+	userID := c.GetString("userID")
+	provider := c.Param("provider")
+
+	user, err := h.userStore.UnlinkIdentity(c.Request.Context(), userID, provider)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrIdentityNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "identity not found"})
+		case errors.Is(err, models.ErrLastLoginMethod):
+			c.JSON(http.StatusConflict, gin.H{"error": "cannot remove the last login method; link another account first"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlink identity"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identitiesOf(user)})
+}
+
+// identitiesOf returns the user's identities, never nil so they encode as a JSON array
+func identitiesOf(user *models.User) []models.Identity {
+	if user.Identities == nil {
+		return []models.Identity{}
+	}
+	return user.Identities
+}
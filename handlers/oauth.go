@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// OAuth2 error codes (RFC 6749 sections 4.1.2.1 and 5.2)
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthInvalidScope            = "invalid_scope"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+	oauthAccessDenied            = "access_denied"
+)
+
+// OAuthTokenResponse is the OAuth2 token endpoint's response
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// CreateOAuthClientRequest describes a new OAuth2 client
+type CreateOAuthClientRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+	// Scope is the space separated list of scopes the client may ask for
+	Scope string `json:"scope" binding:"required"`
+	// RedirectURIs are needed for the authorization code grant
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+	FirstParty   bool     `json:"first_party"`
+}
+
+// OAuthClientResponse carries a new client together with its secret. The
+// secret is only ever shown here; public clients have none.
+type OAuthClientResponse struct {
+	ClientSecret string `json:"client_secret,omitempty"`
+	models.OAuthClient
+}
+
+// OAuthToken is the OAuth2 token endpoint. It takes form encoded requests
+// and supports the authorization_code, refresh_token and client_credentials
+// grants.
+func (h *AuthHandler) OAuthToken(c *gin.Context) {
+	// Token responses must not be cached (RFC 6749 section 5.1)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		h.authorizationCodeGrant(c)
+	case "refresh_token":
+		h.refreshTokenGrant(c)
+	case "client_credentials":
+		h.clientCredentialsGrant(c)
+	case "":
+		oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "grant_type is required")
+	default:
+		oauthError(c, http.StatusBadRequest, oauthUnsupportedGrantType, "grant_type "+grantType+" is not supported")
+	}
+}
+
+// clientCredentialsGrant issues an access token to a client acting for
+// itself. It comes without a refresh token; the client asks again instead.
+func (h *AuthHandler) clientCredentialsGrant(c *gin.Context) {
+	client, ok := h.authenticateClient(c, false)
+	if !ok {
+		return
+	}
+
+	scopes := strings.Fields(c.PostForm("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			oauthError(c, http.StatusBadRequest, oauthInvalidScope, "scope "+scope+" is not allowed for this client")
+			return
+		}
+	}
+	scope := strings.Join(slices.Compact(slices.Sorted(slices.Values(scopes))), " ")
+
+	accessToken, err := h.jwtManager.GenerateClientToken(client.ID, scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(h.jwtManager.AccessTokenTTL().Seconds()),
+		Scope:       scope,
+	})
+}
+
+// authorizationCodeGrant exchanges an authorization code from OAuthAuthorize
+// for the usual access and refresh token pair. The client proves it started
+// the authorization with the PKCE code verifier.
+func (h *AuthHandler) authorizationCodeGrant(c *gin.Context) {
+	client, ok := h.authenticateClient(c, true)
+	if !ok {
+		return
+	}
+
+	code, redirectURI, verifier := c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier")
+	if code == "" || redirectURI == "" || verifier == "" {
+		oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "code, redirect_uri and code_verifier are required")
+		return
+	}
+
+	// Codes are consumed even when the exchange fails, so each can only be tried once
+	authorization, err := h.oauthCodes.Consume(c.Request.Context(), code)
+	if err != nil {
+		if errors.Is(err, models.ErrOAuthCodeNotFound) {
+			if err := h.revokeReplayedCode(c.Request.Context(), code); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens"})
+				return
+			}
+			oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "invalid or expired code")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get authorization code"})
+		return
+	}
+	if authorization.ClientID != client.ID || authorization.RedirectURI != redirectURI {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "code was not issued to this client and redirect_uri")
+		return
+	}
+	if !utils.VerifyPKCE(verifier, authorization.CodeChallenge) {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "code_verifier does not match the code_challenge")
+		return
+	}
+
+	user, err := h.userStore.GetByID(c.Request.Context(), authorization.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "user no longer exists")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// First party apps get the same tokens as a direct login
+	var grant utils.Claims
+	if !client.FirstParty {
+		grant = utils.Claims{ClientID: client.ID, Scope: authorization.Scope}
+	}
+	tokenResp, err := h.issueTokens(c, user, grant)
+	if err != nil {
+		oauthTokenError(c, err)
+		return
+	}
+	use := &models.OAuthCodeUse{UserID: user.ID, SessionID: tokenResp.sessionID}
+	if err := h.oauthCodes.MarkUsed(c.Request.Context(), code, use); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record authorization code use"})
+		return
+	}
+
+	oauthTokens(c, tokenResp)
+}
+
+// revokeReplayedCode revokes the session issued for code if it has already
+// been exchanged, since the code may have been stolen (RFC 6749 section 4.1.2)
+func (h *AuthHandler) revokeReplayedCode(ctx context.Context, code string) error {
+	use, err := h.oauthCodes.Use(ctx, code)
+	if err != nil {
+		if errors.Is(err, models.ErrOAuthCodeNotFound) {
+			return nil
+		}
+		return err
+	}
+	return h.revokeSession(ctx, use.UserID, use.SessionID)
+}
+
+// refreshTokenGrant exchanges a refresh token for a new token pair. The
+// client must be the one the token was issued to; first party apps, whose
+// tokens are the same as a direct login's, may also refresh those.
+func (h *AuthHandler) refreshTokenGrant(c *gin.Context) {
+	client, ok := h.authenticateClient(c, true)
+	if !ok {
+		return
+	}
+
+	refreshToken := c.PostForm("refresh_token")
+	if refreshToken == "" {
+		oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "refresh_token is required")
+		return
+	}
+	claims, err := h.jwtManager.ValidateRefreshToken(refreshToken)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "invalid refresh token")
+		return
+	}
+	// Checked before the token is used, so another client cannot burn it
+	if claims.ClientID != client.ID && (claims.ClientID != "" || !client.FirstParty) {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "refresh token was not issued to this client")
+		return
+	}
+
+	user, err := h.rotateRefreshToken(c.Request.Context(), refreshToken, claims)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenRevoked) {
+			oauthError(c, http.StatusBadRequest, oauthInvalidGrant, err.Error())
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Issue a new token pair in the same family, with the same client and scope
+	tokenResp, err := h.issueTokens(c, user, *claims)
+	if err != nil {
+		oauthTokenError(c, err)
+		return
+	}
+
+	oauthTokens(c, tokenResp)
+}
+
+// oauthTokens writes the token endpoint's response for tokens from issueTokens
+func oauthTokens(c *gin.Context, tokenResp *TokenResponse) {
+	c.JSON(http.StatusOK, OAuthTokenResponse{
+		AccessToken:  tokenResp.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokenResp.ExpiresIn,
+		RefreshToken: tokenResp.RefreshToken,
+		Scope:        tokenResp.Scope,
+	})
+}
+
+// oauthTokenError reports an error from issueTokens at the token endpoint
+func oauthTokenError(c *gin.Context, err error) {
+	if errors.Is(err, errUserBanned) {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, err.Error())
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// authenticateClient checks the client credentials sent with HTTP Basic
+// authentication or as client_id and client_secret form fields, answering
+// invalid_client if they are wrong. With allowPublic, public clients may send
+// their client_id alone.
+func (h *AuthHandler) authenticateClient(c *gin.Context, allowPublic bool) (*models.OAuthClient, bool) {
+	clientID, clientSecret, basic := c.Request.BasicAuth()
+	if basic {
+		// Basic credentials are form encoded first (RFC 6749 section 2.3.1)
+		id, idErr := url.QueryUnescape(clientID)
+		secret, secretErr := url.QueryUnescape(clientSecret)
+		if idErr != nil || secretErr != nil {
+			oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "malformed client credentials")
+			return nil, false
+		}
+		clientID, clientSecret = id, secret
+	} else {
+		clientID, clientSecret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	if allowPublic && clientID != "" && clientSecret == "" {
+		return h.publicClient(c, clientID)
+	}
+	if clientID == "" || clientSecret == "" {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		oauthError(c, http.StatusUnauthorized, oauthInvalidClient, "client authentication is required")
+		return nil, false
+	}
+
+	client, err := h.oauthClients.Authenticate(c.Request.Context(), clientID, clientSecret)
+	if err != nil {
+		if errors.Is(err, models.ErrOAuthClientNotFound) {
+			if basic {
+				c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+			}
+			oauthError(c, http.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+			return nil, false
+		}
+		log.Printf("Failed to authenticate OAuth client %s: %v", clientID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to authenticate client"})
+		return nil, false
+	}
+
+	return client, true
+}
+
+// publicClient returns the public client with clientID, answering
+// invalid_client if there is none
+func (h *AuthHandler) publicClient(c *gin.Context, clientID string) (*models.OAuthClient, bool) {
+	client, err := h.oauthClients.Get(c.Request.Context(), clientID)
+	if err != nil && !errors.Is(err, models.ErrOAuthClientNotFound) {
+		log.Printf("Failed to get OAuth client %s: %v", clientID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to authenticate client"})
+		return nil, false
+	}
+	if err != nil || !client.Public {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		oauthError(c, http.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// oauthError answers with an OAuth2 error response
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// ListOAuthClients returns every registered OAuth2 client
+func (h *AuthHandler) ListOAuthClients(c *gin.Context) {
+	clients, err := h.oauthClients.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list OAuth clients"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+// CreateOAuthClient registers an OAuth2 client
+func (h *AuthHandler) CreateOAuthClient(c *gin.Context) {
+	var req CreateOAuthClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope is required"})
+		return
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(config.KnownScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+	for _, redirectURI := range req.RedirectURIs {
+		if err := validRedirectURI(redirectURI); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Public && len(req.RedirectURIs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "public clients need redirect_uris"})
+		return
+	}
+
+	client := &models.OAuthClient{
+		Name:         req.Name,
+		Scopes:       slices.Compact(slices.Sorted(slices.Values(scopes))),
+		RedirectURIs: req.RedirectURIs,
+		Public:       req.Public,
+		FirstParty:   req.FirstParty,
+	}
+	secret, err := h.oauthClients.Create(c.Request.Context(), client)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create OAuth client"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, OAuthClientResponse{ClientSecret: secret, OAuthClient: *client})
+}
+
+// DeleteOAuthClient removes an OAuth2 client so it cannot get new tokens
+func (h *AuthHandler) DeleteOAuthClient(c *gin.Context) {
+	if err := h.oauthClients.Delete(c.Request.Context(), c.Param("id")); err != nil {
+		if errors.Is(err, models.ErrOAuthClientNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "OAuth client not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete OAuth client"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "OAuth client deleted"})
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// scopeDescriptions tell users what they consent to
+var scopeDescriptions = map[string]string{
+	config.ScopeHouseRead:   "Read house sales data",
+	config.ScopeFortuneRead: "Read your daily fortune",
+}
+
+// authorizePage is the login and consent page of the authorization code flow
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: sans-serif; max-width: 24rem; margin: 3rem auto; padding: 0 1rem; }
+input[type=text], input[type=password] { display: block; width: 100%; box-sizing: border-box; margin: 0.25rem 0 1rem; padding: 0.5rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+{{if .Client}}
+<h1>Sign in to {{.Client.Name}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if not .Client.FirstParty}}
+<p>{{.Client.Name}} would like to:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}
+<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>Username <input type="text" name="username" autocomplete="username" required autofocus></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<button type="submit" name="action" value="allow">{{if .Client.FirstParty}}Sign in{{else}}Allow{{end}}</button>
+{{if not .Client.FirstParty}}<button type="submit" name="action" value="deny" formnovalidate>Deny</button>{{end}}
+</form>
+{{else}}
+<h1>Cannot sign in</h1>
+<p class="error">{{.Error}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// authorizeParams are the authorization request parameters carried from
+// the page to its form submission
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method"}
+
+// authorizeRequest is a validated authorization request
+type authorizeRequest struct {
+	client        *models.OAuthClient
+	redirectURI   string
+	scope         string
+	state         string
+	codeChallenge string
+	params        map[string]string
+}
+
+// OAuthAuthorize shows the login and consent page of the authorization code
+// flow (RFC 6749 section 4.1) to the user a client sent here
+func (h *AuthHandler) OAuthAuthorize(c *gin.Context) {
+	req, ok := h.authorizeRequest(c, c.Query)
+	if !ok {
+		return
+	}
+	h.renderAuthorizePage(c, http.StatusOK, req, "")
+}
+
+// OAuthAuthorizeSubmit handles the login and consent form. It sends the user
+// back to the client with an authorization code once they log in and allow
+// access, or with access_denied if they deny it.
+func (h *AuthHandler) OAuthAuthorizeSubmit(c *gin.Context) {
+	req, ok := h.authorizeRequest(c, c.PostForm)
+	if !ok {
+		return
+	}
+
+	if c.PostForm("action") == "deny" {
+		redirectWithError(c, req, oauthAccessDenied, "the user denied access")
+		return
+	}
+
+	user, err := h.userStore.GetByUsername(c.Request.Context(), c.PostForm("username"))
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(c.PostForm("password")))
+	}
+	if err != nil {
+		h.renderAuthorizePage(c, http.StatusUnauthorized, req, "invalid username or password")
+		return
+	}
+
+	code, err := utils.NewRandomID()
+	if err != nil {
+		h.renderAuthorizePage(c, http.StatusInternalServerError, req, "failed to generate authorization code")
+		return
+	}
+	authorization := &models.OAuthCode{
+		ClientID:      req.client.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.redirectURI,
+		Scope:         req.scope,
+		CodeChallenge: req.codeChallenge,
+	}
+	if err := h.oauthCodes.Save(c.Request.Context(), code, authorization); err != nil {
+		h.renderAuthorizePage(c, http.StatusInternalServerError, req, "failed to store authorization code")
+		return
+	}
+
+	redirect(c, req, url.Values{"code": {code}})
+}
+
+// authorizeRequest validates the authorization request parameters read with
+// get. Without a known client and one of its redirect URIs there is nowhere
+// safe to send the user back to, so those errors are shown on the page; the
+// others are reported to the client's redirect URI.
+func (h *AuthHandler) authorizeRequest(c *gin.Context, get func(string) string) (*authorizeRequest, bool) {
+	clientID := get("client_id")
+	if clientID == "" {
+		h.renderAuthorizePage(c, http.StatusBadRequest, nil, "client_id is required")
+		return nil, false
+	}
+	client, err := h.oauthClients.Get(c.Request.Context(), clientID)
+	if err != nil {
+		if errors.Is(err, models.ErrOAuthClientNotFound) {
+			h.renderAuthorizePage(c, http.StatusBadRequest, nil, "unknown client")
+			return nil, false
+		}
+		h.renderAuthorizePage(c, http.StatusInternalServerError, nil, "failed to get client")
+		return nil, false
+	}
+	redirectURI := get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		h.renderAuthorizePage(c, http.StatusBadRequest, nil, "redirect_uri is not registered for this client")
+		return nil, false
+	}
+
+	req := &authorizeRequest{
+		client:        client,
+		redirectURI:   redirectURI,
+		state:         get("state"),
+		codeChallenge: get("code_challenge"),
+		params:        make(map[string]string, len(authorizeParams)),
+	}
+	for _, name := range authorizeParams {
+		req.params[name] = get(name)
+	}
+
+	if responseType := get("response_type"); responseType != "code" {
+		redirectWithError(c, req, oauthUnsupportedResponseType, "response_type must be code")
+		return nil, false
+	}
+	if get("code_challenge_method") != utils.PKCEMethodS256 || !utils.ValidCodeChallenge(req.codeChallenge) {
+		redirectWithError(c, req, oauthInvalidRequest, "a PKCE code_challenge with code_challenge_method S256 is required")
+		return nil, false
+	}
+
+	scopes := strings.Fields(get("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			redirectWithError(c, req, oauthInvalidScope, "scope "+scope+" is not allowed for this client")
+			return nil, false
+		}
+	}
+	req.scope = strings.Join(slices.Compact(slices.Sorted(slices.Values(scopes))), " ")
+
+	return req, true
+}
+
+// renderAuthorizePage shows the login and consent page for req, or only
+// message when req is nil
+func (h *AuthHandler) renderAuthorizePage(c *gin.Context, status int, req *authorizeRequest, message string) {
+	data := struct {
+		Client *models.OAuthClient
+		Scopes []string
+		Params map[string]string
+		Error  string
+	}{Error: message}
+	if req != nil {
+		data.Client = req.client
+		data.Params = req.params
+		for _, scope := range strings.Fields(req.scope) {
+			if description, ok := scopeDescriptions[scope]; ok {
+				scope = description
+			}
+			data.Scopes = append(data.Scopes, scope)
+		}
+	}
+
+	// The page takes passwords, so keep it out of caches and frames
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := authorizePage.Execute(c.Writer, data); err != nil {
+		c.Error(err)
+	}
+}
+
+// redirectWithError sends the user back to the client with an OAuth2 error
+func redirectWithError(c *gin.Context, req *authorizeRequest, code, description string) {
+	redirect(c, req, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// redirect sends the user back to the client's redirect URI with params and
+// the request's state
+func redirect(c *gin.Context, req *authorizeRequest, params url.Values) {
+	// Registered redirect URIs are validated, so this cannot fail
+	u, _ := url.Parse(req.redirectURI)
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+	u.RawQuery = query.Encode()
+
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// validRedirectURI reports an error if uri cannot be registered as a redirect
+// URI: it must be an absolute https URL without a fragment, or http on the
+// loopback interface for apps running locally
+func validRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("redirect URI %q must be an absolute URL", uri)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("redirect URI %q must not have a fragment", uri)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+			return nil
+		}
+	}
+	return fmt.Errorf("redirect URI %q must use https, or http on localhost", uri)
+}
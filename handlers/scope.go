@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DownscopeRequest names the scopes the down-scoped token should grant
+type DownscopeRequest struct {
+	// Scope is a space separated subset of the caller's scopes
+	Scope string `json:"scope" binding:"required"`
+}
+
+// DownscopeResponse carries a down-scoped access token. It has no refresh
+// token; the client asks for a new one with its full token.
+type DownscopeResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"` // seconds
+	Scope       string `json:"scope"`
+}
+
+// DownscopeToken issues an access token granting only some of the caller's
+// scopes, e.g. to hand to a service that needs nothing else. It carries no
+// roles, expires no later than the caller's token and is revoked with the
+// caller's session or API key.
+func (h *AuthHandler) DownscopeToken(c *gin.Context) {
+	var req DownscopeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope is required"})
+		return
+	}
+	granted := c.GetStringSlice("scopes")
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scope " + scope + " is not granted to this token"})
+			return
+		}
+	}
+	slices.Sort(scopes)
+	scope := strings.Join(slices.Compact(scopes), " ")
+
+	// The token stays tied to the OAuth2 client, login session or API key the
+	// caller's belongs to, but is marked so it cannot manage the account
+	claims := utils.Claims{
+		UserID:     c.GetString("userID"),
+		FamilyID:   c.GetString("sessionID"),
+		Scope:      scope,
+		ClientID:   c.GetString("clientID"),
+		Downscoped: true,
+		APIKeyID:   c.GetString("apiKeyID"),
+	}
+	ttl := h.jwtManager.AccessTokenTTL()
+	// Requests made with an API key have no expiry to stay within
+	if expiresAt := c.GetTime("expiresAt"); !expiresAt.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+		ttl = min(ttl, time.Until(expiresAt))
+	}
+
+	accessToken, err := h.jwtManager.GenerateAccessToken(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, DownscopeResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   int64(ttl.Seconds()),
+		Scope:       scope,
+	})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ListSessions returns the current user's active sessions
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	userID, err := h.resolveUserID(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	sessions, err := h.sessionStore.ListByUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession logs out one of the current user's sessions
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	sessionID := c.Param("id")
+	userID, err := h.resolveUserID(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Only allow revoking the user's own sessions
+	session, err := h.sessionStore.Get(c.Request.Context(), sessionID)
+	if err != nil {
+		if errors.Is(err, models.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get session"})
+		return
+	}
+	if session.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if err := h.revokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// RevokeAllSessions logs the current user out everywhere
+func (h *AuthHandler) RevokeAllSessions(c *gin.Context) {
+	revoked, err := h.logOutEverywhere(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "all sessions revoked",
+		"revoked": revoked,
+	})
+}
+
+// logOutEverywhere revokes every session of a user and every access token
+// issued to them, including down-scoped ones, and returns how many sessions
+// were revoked
+func (h *AuthHandler) logOutEverywhere(ctx context.Context, userID string) (int, error) {
+	currentID, err := h.resolveUserID(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	sessions, err := h.sessionStore.ListByUser(ctx, currentID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, session := range sessions {
+		if err := h.revokeSession(ctx, currentID, session.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := h.revokeAccessTokens(ctx, currentID, userID); err != nil {
+		return 0, err
+	}
+	return len(sessions), nil
+}
+
+// revokeAccessTokens revokes the access tokens issued so far to the user with
+// the current ID currentID, including those carrying userID
+func (h *AuthHandler) revokeAccessTokens(ctx context.Context, currentID, userID string) error {
+	// Tokens issued before the ID migration carry the legacy ID
+	for _, id := range slices.Compact([]string{currentID, userID}) {
+		if err := h.denylist.RevokeUser(ctx, id, h.jwtManager.AccessTokenTTL()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveUserID returns the current ID of a user, following the alias of the
+// legacy ID that tokens issued before the ID migration still carry. IDs of
+// users that no longer exist are returned as they are.
+func (h *AuthHandler) resolveUserID(ctx context.Context, userID string) (string, error) {
+	user, err := h.userStore.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			return userID, nil
+		}
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// revokeSession removes a session together with its refresh token family and
+// revokes the access tokens issued to it. userID must be the user's current
+// ID, see resolveUserID.
+func (h *AuthHandler) revokeSession(ctx context.Context, userID, sessionID string) error {
+	if err := h.refreshTokenStore.RevokeFamily(ctx, sessionID); err != nil {
+		return err
+	}
+	if err := h.denylist.RevokeSession(ctx, sessionID, h.jwtManager.AccessTokenTTL()); err != nil {
+		return err
+	}
+	return h.sessionStore.Delete(ctx, userID, sessionID)
+}
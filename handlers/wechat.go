@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// WeChatPhoneRequest carries the code returned by the Mini Program's
+// getPhoneNumber button
+type WeChatPhoneRequest struct {
+	Code string `json:"code" binding:"required"`
+	// App is the Mini Program the code comes from, as in WeChatLoginRequest
+	App string `json:"app"`
+}
+
+// wechatApp returns the name of the WeChat app a request comes from: the
+// :app path segment or the app named in the request, else the default app.
+// On failure it writes the error response and returns false.
+func (h *AuthHandler) wechatApp(c *gin.Context, requested, appType string) (string, bool) {
+	name := c.Param("app")
+	if name == "" {
+		name = requested
+	} else if requested != "" && requested != name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "app in the path and in the request differ"})
+		return "", false
+	}
+
+	app, err := h.wechatManager.App(name, appType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown WeChat app"})
+		return "", false
+	}
+	return app, true
+}
+
+// wechatError writes the response for a failed call to WeChat, made to
+// action. Clients get a plain message; WeChat's own error is only logged.
+func wechatError(c *gin.Context, action string, err error) {
+	switch {
+	case errors.Is(err, utils.ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired code"})
+	case errors.Is(err, utils.ErrWatermarkMismatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code was not issued for this app"})
+	case errors.Is(err, utils.ErrHighRiskUser):
+		c.JSON(http.StatusForbidden, gin.H{"error": "WeChat account is restricted"})
+	case errors.Is(err, utils.ErrRateLimited):
+		// WeChat's quotas are per minute
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many requests, try again later"})
+	case errors.Is(err, utils.ErrWeChatUnavailable):
+		log.Printf("Failed to %s, WeChat is unavailable: %v", action, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WeChat is unavailable, try again later"})
+	default:
+		log.Printf("Failed to %s with WeChat: %v", action, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to " + action})
+	}
+}
+
+// WeChatPhoneLogin logs in with the phone number verified by WeChat,
+// creating a user for numbers seen for the first time
+func (h *AuthHandler) WeChatPhoneLogin(c *gin.Context) {
+	var req WeChatPhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	app, ok := h.wechatApp(c, req.App, config.WeChatAppMiniProgram)
+	if !ok {
+		return
+	}
+	phone, ok := h.wechatPhoneNumber(c, app, req.Code)
+	if !ok {
+		return
+	}
+
+	user, err := models.FindOrCreatePhoneUser(c.Request.Context(), h.userStore, phone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to create user: %v", err)})
+		return
+	}
+
+	// Generate tokens
+	tokenResp, err := h.issueTokens(c, user, utils.Claims{WeChatApp: app})
+	if err != nil {
+		tokenError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResp)
+}
+
+// wechatPhoneNumber exchanges a getPhoneNumber code from app for the phone
+// number in E.164 form. On failure it writes the error response and returns false.
+func (h *AuthHandler) wechatPhoneNumber(c *gin.Context, app, code string) (string, bool) {
+	info, err := h.wechatManager.GetPhoneNumber(c.Request.Context(), app, code)
+	if err != nil {
+		wechatError(c, "get phone number", err)
+		return "", false
+	}
+	return info.E164(), true
+}
+
+// WeChatUserDataRequest carries data returned by Mini Program APIs such as
+// wx.getUserProfile. RawData and Signature are only sent by APIs that sign
+// their plain data; EncryptedData and IV are always present.
+type WeChatUserDataRequest struct {
+	RawData       string `json:"raw_data"`
+	Signature     string `json:"signature" binding:"required_with=RawData"`
+	EncryptedData string `json:"encrypted_data" binding:"required"`
+	IV            string `json:"iv" binding:"required"`
+}
+
+// WeChatUserData verifies and decrypts Mini Program data with the current
+// user's session key for the app they logged in from, updates the user's
+// profile from it and returns the decrypted data together with the profile
+func (h *AuthHandler) WeChatUserData(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	var req WeChatUserDataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Tokens from other logins fall back to the default app
+	app, ok := h.wechatApp(c, c.GetString("wechatApp"), config.WeChatAppMiniProgram)
+	if !ok {
+		return
+	}
+
+	sessionKey, err := h.wechatSessionKeys.Get(c.Request.Context(), app, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrSessionKeyNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "WeChat session expired, log in with wx.login again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get WeChat session"})
+		return
+	}
+
+	if req.RawData != "" && !utils.VerifySignature(req.RawData, req.Signature, sessionKey) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	plaintext, err := h.wechatManager.DecryptData(app, sessionKey, req.EncryptedData, req.IV)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrInvalidEncryptedData):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decrypt data"})
+		case errors.Is(err, utils.ErrWatermarkMismatch):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "data was not produced for this app"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt data"})
+		}
+		return
+	}
+
+	var info utils.WeChatUserInfo
+	var data map[string]any
+	if err := json.Unmarshal(plaintext, &info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decrypt data"})
+		return
+	}
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decrypt data"})
+		return
+	}
+	delete(data, "watermark")
+
+	user, err := h.userStore.GetByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+	identity := user.Identity(models.WeChatIdentityProvider(app))
+	if info.OpenID != "" && (identity == nil || info.OpenID != identity.Subject) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "data belongs to another WeChat account"})
+		return
+	}
+
+	// Group and share data carry no profile; only update what was sent
+	if info.NickName != "" || info.AvatarURL != "" {
+		if info.NickName != "" {
+			user.Nickname = info.NickName
+		}
+		if info.AvatarURL != "" {
+			user.AvatarURL = info.AvatarURL
+		}
+		if err := h.userStore.Update(c.Request.Context(), user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"profile": gin.H{
+			"nickname":   user.Nickname,
+			"avatar_url": user.AvatarURL,
+		},
+		"data": data,
+	})
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// wechatOAuthStateCookie binds a web login to the browser that started it,
+// so a callback URL cannot be used to log someone else in
+const wechatOAuthStateCookie = "wechat_oauth_state"
+
+// wechatLoginCodeTTL is how long an H5 page has to exchange its login code
+const wechatLoginCodeTTL = time.Minute
+
+// WeChatOAuthTokenRequest is the login code an H5 page exchanges for tokens
+type WeChatOAuthTokenRequest struct {
+	LoginCode string `json:"login_code" binding:"required"`
+}
+
+// WeChatOAuthAuthorize starts a web login for H5 pages opened inside WeChat
+// by redirecting to the Official Account authorize page. The account is given
+// by the :app path segment or the app query parameter, and defaults to the
+// default app. The scope query parameter is snsapi_base (the default) or
+// snsapi_userinfo, and return_url is the page to come back to, which must be
+// one of the account's return URLs.
+func (h *AuthHandler) WeChatOAuthAuthorize(c *gin.Context) {
+	app, ok := h.wechatApp(c, c.Query("app"), config.WeChatAppOfficialAccount)
+	if !ok {
+		return
+	}
+
+	scope := c.DefaultQuery("scope", utils.OAuthScopeBase)
+	if scope != utils.OAuthScopeBase && scope != utils.OAuthScopeUserInfo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be snsapi_base or snsapi_userinfo"})
+		return
+	}
+	returnURL := c.Query("return_url")
+	if !h.wechatManager.OAuthReturnURLAllowed(app, returnURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "return_url is not allowed for this app"})
+		return
+	}
+
+	state, err := utils.NewRandomID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate state"})
+		return
+	}
+	authorizeURL, err := h.wechatManager.OAuthAuthorizeURL(app, scope, state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build authorize URL"})
+		return
+	}
+	ttl := h.wechatManager.OAuthStateTTL()
+	login := &models.WeChatOAuthState{App: app, Scope: scope, ReturnURL: returnURL}
+	if err := h.wechatOAuthStates.Save(c.Request.Context(), state, login, ttl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store state"})
+		return
+	}
+
+	h.setWeChatOAuthStateCookie(c, app, state, int(ttl.Seconds()))
+	c.Redirect(http.StatusFound, authorizeURL)
+}
+
+// setWeChatOAuthStateCookie sets the state cookie for the callback of app,
+// or deletes it when maxAge is negative
+func (h *AuthHandler) setWeChatOAuthStateCookie(c *gin.Context, app, state string, maxAge int) {
+	callback, err := h.wechatManager.OAuthRedirectURL(app)
+	if err != nil {
+		return
+	}
+	// Lax, since WeChat sends the user back with a top-level redirect
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(wechatOAuthStateCookie, state, maxAge, callback.Path, "", callback.Scheme == "https", true)
+}
+
+// WeChatOAuthCallback completes a web login: WeChat redirects here with the
+// code and the state from WeChatOAuthAuthorize, which must match the state
+// cookie. The user is found by UnionID or Official Account OpenID, so someone
+// who also uses the Mini Program gets the same account. The browser is sent
+// back to the return URL with a one-time login_code for
+// WeChatOAuthToken, or with an error.
+func (h *AuthHandler) WeChatOAuthCallback(c *gin.Context) {
+	state := c.Query("state")
+	if state == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state is required"})
+		return
+	}
+	cookie, err := c.Cookie(wechatOAuthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state was not issued to this browser"})
+		return
+	}
+
+	login, err := h.wechatOAuthStates.Consume(c.Request.Context(), state)
+	if err != nil {
+		if errors.Is(err, models.ErrOAuthStateNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired state"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get state"})
+		return
+	}
+	h.setWeChatOAuthStateCookie(c, login.App, "", -1)
+
+	userID, errCode := h.wechatOAuthUser(c, login)
+	if errCode != "" {
+		wechatOAuthReturn(c, login, url.Values{"error": {errCode}})
+		return
+	}
+
+	code, err := utils.NewRandomID()
+	if err != nil {
+		wechatOAuthReturn(c, login, url.Values{"error": {"server_error"}})
+		return
+	}
+	webLogin := &models.WeChatWebLogin{UserID: userID, App: login.App}
+	if err := h.wechatOAuthStates.SaveLogin(c.Request.Context(), code, webLogin, wechatLoginCodeTTL); err != nil {
+		log.Printf("Failed to store WeChat web login: %v", err)
+		wechatOAuthReturn(c, login, url.Values{"error": {"server_error"}})
+		return
+	}
+
+	wechatOAuthReturn(c, login, url.Values{"login_code": {code}})
+}
+
+// wechatOAuthUser finds or creates the user of a web login with the code
+// WeChat sent to the callback. On failure it returns the error code for the
+// return URL instead.
+func (h *AuthHandler) wechatOAuthUser(c *gin.Context, login *models.WeChatOAuthState) (string, string) {
+	code := c.Query("code")
+	if code == "" {
+		// WeChat leaves out the code when the user declines
+		return "", "access_denied"
+	}
+
+	token, err := h.wechatManager.OAuthExchange(c.Request.Context(), login.App, code)
+	if err != nil {
+		log.Printf("Failed to exchange code with WeChat: %v", err)
+		return "", "wechat_error"
+	}
+	if token.IsSnapshotUser == 1 {
+		return "", "snapshot_user"
+	}
+
+	unionID := token.UnionID
+	var info *utils.OAuthUserInfo
+	if login.Scope == utils.OAuthScopeUserInfo {
+		info, err = h.wechatManager.OAuthUserInfo(c.Request.Context(), token)
+		if err != nil {
+			log.Printf("Failed to get user info from WeChat: %v", err)
+			return "", "wechat_error"
+		}
+		if info.UnionID != "" {
+			unionID = info.UnionID
+		}
+	}
+
+	provider := models.WeChatIdentityProvider(login.App)
+	user, err := models.FindOrCreateWeChatUser(c.Request.Context(), h.userStore, provider, token.OpenID, unionID)
+	if err != nil {
+		log.Printf("Failed to create WeChat user: %v", err)
+		return "", "server_error"
+	}
+	if user.Banned {
+		return "", "user_banned"
+	}
+
+	// Keep the profile the user just agreed to share
+	if info != nil && (info.Nickname != user.Nickname || info.HeadImgURL != user.AvatarURL) {
+		if info.Nickname != "" {
+			user.Nickname = info.Nickname
+		}
+		if info.HeadImgURL != "" {
+			user.AvatarURL = info.HeadImgURL
+		}
+		if err := h.userStore.Update(c.Request.Context(), user); err != nil {
+			log.Printf("Failed to update WeChat user: %v", err)
+			return "", "server_error"
+		}
+	}
+	return user.ID, ""
+}
+
+// wechatOAuthReturn redirects the browser back to the page that started a web
+// login, adding params to the page's query
+func wechatOAuthReturn(c *gin.Context, login *models.WeChatOAuthState, params url.Values) {
+	// The return URL was checked in WeChatOAuthAuthorize
+	u, err := url.Parse(login.ReturnURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid return URL"})
+		return
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// WeChatOAuthToken exchanges the login code of a finished web login for the
+// same token pair as POST /wechat/login. Each code works once.
+func (h *AuthHandler) WeChatOAuthToken(c *gin.Context) {
+	var req WeChatOAuthTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	login, err := h.wechatOAuthStates.ConsumeLogin(c.Request.Context(), req.LoginCode)
+	if err != nil {
+		if errors.Is(err, models.ErrWeChatLoginNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired login code"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get login"})
+		return
+	}
+
+	user, err := h.userStore.GetByID(c.Request.Context(), login.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired login code"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Generate tokens
+	tokenResp, err := h.issueTokens(c, user, utils.Claims{WeChatApp: login.App})
+	if err != nil {
+		tokenError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResp)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -17,42 +18,93 @@ import (
 	"github.com/LIUHUANUCAS/auth/models"
 	"github.com/LIUHUANUCAS/auth/utils"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to the YAML config file")
+	migrateUserIDs := flag.Bool("migrate-user-ids", false, "give users with legacy (username based) IDs a generated ID, then exit")
+	grantAdmin := flag.String("grant-admin", "", "give the user with this username the admin role, then exit")
+	flag.Parse()
+
 	// Load configuration
-	cfg := config.GetConfig()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
 	ctx := context.Background()
 
 	// Initialize Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     cfg.Redis.Addr,
-		Password: cfg.Redis.Password,
-		DB:       cfg.Redis.DB,
-	})
-
-	// Ping Redis to check connection
-	_, err := redisClient.Ping(context.Background()).Result()
+	redisClient, closeRedis, err := openRedis(ctx, cfg)
 	if err != nil {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
-	log.Println("Connected to Redis")
+	defer closeRedis()
 
 	// Initialize user store
-	userStore := models.NewUserStore(redisClient)
+	var userStore models.UserRepository
+	switch cfg.Storage.Driver {
+	case config.StorageDriverMemory:
+		log.Println("Using in-memory user store, accounts are lost on restart")
+		userStore = models.NewMemoryUserStore()
+	case config.StorageDriverSQLite, config.StorageDriverPostgres:
+		db, err := openDB(cfg.Storage)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+
+		sqlStore := models.NewSQLUserStore(db)
+		if err := sqlStore.Migrate(ctx); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		log.Printf("Using %s user store", cfg.Storage.Driver)
+		userStore = sqlStore
+	default:
+		userStore = models.NewRedisUserStore(redisClient)
+	}
+
+	// Initialize refresh token store
+	refreshTokenStore := models.NewRefreshTokenStore(redisClient)
+
+	// Initialize access token denylist
+	denylist := models.NewTokenDenylist(redisClient, cfg.JWT.DenylistCacheTTL)
+
+	// Initialize session store
+	sessionStore := models.NewSessionStore(redisClient)
+
+	// Initialize API key, OAuth2 client and authorization code stores
+	apiKeys := models.NewAPIKeyStore(redisClient)
+	oauthClients := models.NewOAuthClientStore(redisClient)
+	oauthCodes := models.NewOAuthCodeStore(redisClient, cfg.OAuth.CodeTTL)
+
+	if *migrateUserIDs {
+		runUserIDMigration(ctx, userStore, sessionStore, apiKeys, cfg.JWT.RefreshTokenTTL)
+		return
+	}
+	if *grantAdmin != "" {
+		runGrantAdmin(ctx, userStore, *grantAdmin)
+		return
+	}
 
 	// Initialize JWT manager
-	jwtManager := utils.NewJWTManager(&cfg.JWT)
+	jwtManager, err := utils.NewJWTManager(&cfg.JWT)
+	if err != nil {
+		log.Fatalf("Failed to initialize JWT manager: %v", err)
+	}
 
-	// Initialize WeChat manager
-	wechatManager := utils.NewWeChatManager(&cfg.WeChat)
+	// Initialize WeChat manager, sharing access tokens through Redis, and the session key and web login state stores
+	wechatManager := utils.NewWeChatManager(&cfg.WeChat, models.NewWeChatAccessTokenStore(redisClient))
+	wechatSessionKeys := models.NewWeChatSessionKeyStore(redisClient)
+	wechatOAuthStates := models.NewWeChatOAuthStateStore(redisClient)
 
 	// Initialize auth middleware
-	authMiddleware := middleware.NewAuthMiddleware(jwtManager)
+	authMiddleware := middleware.NewAuthMiddleware(jwtManager, denylist, apiKeys, userStore)
 
 	// Initialize auth handler
-	authHandler := handlers.NewAuthHandler(userStore, jwtManager, wechatManager, redisClient)
+	authHandler := handlers.NewAuthHandler(userStore, refreshTokenStore, sessionStore, denylist, jwtManager, wechatManager, wechatSessionKeys, wechatOAuthStates, apiKeys, oauthClients, oauthCodes)
 
 	// Initialize Gin router
 	router := gin.Default()
@@ -64,11 +116,8 @@ func main() {
 		})
 	})
 
-	// Create reverse proxy for localhost:8081
-	targetURL, err := url.Parse(cfg.Server.ProxyURL)
-	if err != nil {
-		log.Fatalf("Failed to parse target URL: %v", err)
-	}
+	// Create reverse proxy for the configured upstream (already validated)
+	targetURL, _ := url.Parse(cfg.Server.ProxyURL)
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
 
 	// Handler function for reverse proxy
@@ -84,17 +133,53 @@ func main() {
 	}
 
 	// Public routes
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
 	router.POST("/register", authHandler.Register)
 	router.POST("/login", authHandler.Login)
 	router.POST("/refresh", authHandler.RefreshToken)
 	router.POST("/logout", authHandler.Logout)
-	router.POST("/wechat/login", authHandler.WeChatLogin)
+	router.GET("/oauth/authorize", authHandler.OAuthAuthorize)
+	router.POST("/oauth/authorize", authHandler.OAuthAuthorizeSubmit)
+	router.POST("/oauth/token", authHandler.OAuthToken)
+	if cfg.WeChat.Enabled {
+		// Requests name their app in the path or the body, or use the default app
+		router.POST("/wechat/login", authHandler.WeChatLogin)
+		router.POST("/wechat/:app/login", authHandler.WeChatLogin)
+		router.POST("/wechat/phone", authHandler.WeChatPhoneLogin)
+		router.POST("/wechat/:app/phone", authHandler.WeChatPhoneLogin)
+		if cfg.WeChat.HasAppType(config.WeChatAppOfficialAccount) {
+			router.GET("/wechat/oauth/authorize", authHandler.WeChatOAuthAuthorize)
+			router.GET("/wechat/:app/oauth/authorize", authHandler.WeChatOAuthAuthorize)
+			router.GET("/wechat/oauth/callback", authHandler.WeChatOAuthCallback)
+			router.POST("/wechat/oauth/token", authHandler.WeChatOAuthToken)
+		}
+	}
 
 	// Protected routes
 	protected := router.Group("/")
 	protected.Use(authMiddleware.AuthRequired())
 	{
-		protected.GET("/me", authHandler.Me)
+		protected.GET("/me", authMiddleware.RequireUser(), authHandler.Me)
+		protected.POST("/token/downscope", authMiddleware.RequireUser(), authHandler.DownscopeToken)
+
+		// Managing the account takes an access token, API keys only reach its APIs
+		account := protected.Group("/me", authMiddleware.RequireSession())
+		{
+			account.POST("/password", authHandler.ChangePassword)
+			account.GET("/sessions", authHandler.ListSessions)
+			account.DELETE("/sessions/:id", authHandler.RevokeSession)
+			account.POST("/sessions/revoke-all", authHandler.RevokeAllSessions)
+			account.GET("/identities", authHandler.ListIdentities)
+			account.DELETE("/identities/:provider", authHandler.UnlinkIdentity)
+			if cfg.WeChat.Enabled {
+				account.POST("/identities/wechat", authHandler.LinkWeChat)
+				account.POST("/identities/phone", authHandler.LinkPhone)
+				account.POST("/wechat/user-data", authHandler.WeChatUserData)
+			}
+			account.GET("/api-keys", authHandler.ListAPIKeys)
+			account.POST("/api-keys", authHandler.CreateAPIKey)
+			account.DELETE("/api-keys/:id", authHandler.RevokeAPIKey)
+		}
 
 		// Example protected API endpoint
 		protected.GET("/api/protected", func(c *gin.Context) {
@@ -105,14 +190,33 @@ func main() {
 			})
 		})
 
-		// Proxy routes that require authentication
-		protected.GET("/v1/daily_house", proxyHandler)
-		protected.GET("/v1/daily_new_house", proxyHandler)
-		protected.GET("/v1/daily_unfinished_house", proxyHandler)
-		protected.GET("/v1/month_house", proxyHandler)
-		protected.GET("/v2/sh/new_daily_house", proxyHandler)
-		protected.GET("/v2/sh/old_daily_house", proxyHandler)
-		protected.GET("/v3/fortune/daily", proxyHandler)
+		// Staff can look users up, only admins can change their roles and
+		// manage service accounts and API keys
+		admin := protected.Group("/admin", authMiddleware.RequireSession())
+		{
+			admin.GET("/users/:id", authMiddleware.RequireAnyRole(models.RoleStaff, models.RoleAdmin), authHandler.GetUser)
+			admin.POST("/users/:id/roles", authMiddleware.RequireRole(models.RoleAdmin), authHandler.GrantRole)
+			admin.DELETE("/users/:id/roles/:role", authMiddleware.RequireRole(models.RoleAdmin), authHandler.RevokeRole)
+			admin.POST("/users/:id/ban", authMiddleware.RequireRole(models.RoleAdmin), authHandler.BanUser)
+			admin.DELETE("/users/:id/ban", authMiddleware.RequireRole(models.RoleAdmin), authHandler.UnbanUser)
+			admin.POST("/service-accounts", authMiddleware.RequireRole(models.RoleAdmin), authHandler.CreateServiceAccount)
+			admin.GET("/users/:id/api-keys", authMiddleware.RequireRole(models.RoleAdmin), authHandler.ListUserAPIKeys)
+			admin.POST("/users/:id/api-keys", authMiddleware.RequireRole(models.RoleAdmin), authHandler.CreateUserAPIKey)
+			admin.DELETE("/users/:id/api-keys/:key_id", authMiddleware.RequireRole(models.RoleAdmin), authHandler.RevokeUserAPIKey)
+			admin.GET("/oauth/clients", authMiddleware.RequireRole(models.RoleAdmin), authHandler.ListOAuthClients)
+			admin.POST("/oauth/clients", authMiddleware.RequireRole(models.RoleAdmin), authHandler.CreateOAuthClient)
+			admin.DELETE("/oauth/clients/:id", authMiddleware.RequireRole(models.RoleAdmin), authHandler.DeleteOAuthClient)
+		}
+
+		// Proxy routes that require authentication and the scope of the data they serve
+		houseRead := authMiddleware.RequireScope(config.ScopeHouseRead)
+		protected.GET("/v1/daily_house", houseRead, proxyHandler)
+		protected.GET("/v1/daily_new_house", houseRead, proxyHandler)
+		protected.GET("/v1/daily_unfinished_house", houseRead, proxyHandler)
+		protected.GET("/v1/month_house", houseRead, proxyHandler)
+		protected.GET("/v2/sh/new_daily_house", houseRead, proxyHandler)
+		protected.GET("/v2/sh/old_daily_house", houseRead, proxyHandler)
+		protected.GET("/v3/fortune/daily", authMiddleware.RequireScope(config.ScopeFortuneRead), proxyHandler)
 	}
 
 	srv := &http.Server{
@@ -133,6 +237,26 @@ func main() {
 		}
 	}()
 
+	// Reload the JWT keys from the config file on SIGHUP so keys can be rotated without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			newCfg, err := config.Load(*configPath)
+			if err == nil {
+				err = newCfg.Validate()
+			}
+			if err == nil {
+				err = jwtManager.ReloadKeys(&newCfg.JWT)
+			}
+			if err != nil {
+				log.Printf("Failed to reload JWT keys: %v", err)
+				continue
+			}
+			log.Println("Reloaded JWT keys")
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shut down the server
 	quit := make(chan os.Signal, 1)
 	// Accept graceful shutdown signals
@@ -148,3 +272,40 @@ func main() {
 	log.Println("Server exiting")
 
 }
+
+// runUserIDMigration moves users with legacy IDs to generated ones. The old
+// IDs keep resolving through aliases, so tokens issued before the migration
+// stay valid until they expire. Sessions and API keys move to the new IDs.
+func runUserIDMigration(ctx context.Context, userStore models.UserRepository, sessionStore *models.SessionStore, apiKeys *models.APIKeyStore, sessionTTL time.Duration) {
+	migrator, ok := userStore.(models.LegacyIDMigrator)
+	if !ok {
+		log.Fatalf("The configured user store does not support ID migration")
+	}
+
+	migrated, err := migrator.MigrateLegacyIDs(ctx)
+	for oldID, newID := range migrated {
+		if err := sessionStore.ReassignUser(ctx, oldID, newID, sessionTTL); err != nil {
+			log.Printf("Failed to move sessions of %s to %s: %v", oldID, newID, err)
+		}
+		if err := apiKeys.ReassignUser(ctx, oldID, newID); err != nil {
+			log.Printf("Failed to move API keys of %s to %s: %v", oldID, newID, err)
+		}
+	}
+	log.Printf("Migrated %d user IDs", len(migrated))
+	if err != nil {
+		log.Fatalf("User ID migration failed: %v", err)
+	}
+}
+
+// runGrantAdmin gives the user called username the admin role, which is how
+// the first admin is created
+func runGrantAdmin(ctx context.Context, userStore models.UserRepository, username string) {
+	user, err := userStore.GetByUsername(ctx, username)
+	if err != nil {
+		log.Fatalf("Failed to find user %s: %v", username, err)
+	}
+	if _, err := userStore.GrantRole(ctx, user.ID, models.RoleAdmin); err != nil {
+		log.Fatalf("Failed to grant admin role: %v", err)
+	}
+	log.Printf("Granted the admin role to %s (%s)", username, user.ID)
+}
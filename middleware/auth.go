@@ -2,9 +2,13 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
+	"github.com/LIUHUANUCAS/auth/models"
 	"github.com/LIUHUANUCAS/auth/utils"
 	"github.com/gin-gonic/gin"
 )
@@ -12,18 +16,31 @@ import (
 // AuthMiddleware is a middleware for authentication
 type AuthMiddleware struct {
 	jwtManager *utils.JWTManager
+	denylist   *models.TokenDenylist
+	apiKeys    *models.APIKeyStore
+	userStore  models.UserRepository
 }
 
 // NewAuthMiddleware creates a new AuthMiddleware
-func NewAuthMiddleware(jwtManager *utils.JWTManager) *AuthMiddleware {
+func NewAuthMiddleware(jwtManager *utils.JWTManager, denylist *models.TokenDenylist, apiKeys *models.APIKeyStore, userStore models.UserRepository) *AuthMiddleware {
 	return &AuthMiddleware{
 		jwtManager: jwtManager,
+		denylist:   denylist,
+		apiKeys:    apiKeys,
+		userStore:  userStore,
 	}
 }
 
-// AuthRequired is a middleware that requires authentication
+// AuthRequired is a middleware that requires authentication with an access
+// token or an API key
 func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// API keys come in their own header or as an ApiKey authorization
+		if key := apiKeyFromRequest(c); key != "" {
+			m.authenticateAPIKey(c, key)
+			return
+		}
+
 		// Get the Authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -54,14 +71,214 @@ func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 			return
 		}
 
-		// Set the user ID in the context
+		// Reject tokens that have been revoked before they expired, on their
+		// own or with their session
+		revoked, err := m.isRevoked(c.Request.Context(), claims)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to check token status",
+			})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Token has been revoked",
+			})
+			return
+		}
+
+		// Set the user ID, the WeChat app the user logged in from, their roles
+		// and what the token grants in the context
 		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.FamilyID)
+		c.Set("clientID", claims.ClientID)
+		c.Set("apiKeyID", claims.APIKeyID)
+		c.Set("downscoped", claims.Downscoped)
+		c.Set("wechatApp", claims.WeChatApp)
+		c.Set("roles", claims.Roles)
+		c.Set("scopes", claims.Scopes())
+		c.Set("expiresAt", claims.ExpiresAt.Time)
 
 		// Continue
 		c.Next()
 	}
 }
 
+// isRevoked reports whether an access token has been revoked, the session or
+// API key it belongs to has been logged out or revoked, or every token of its
+// user has been revoked
+func (m *AuthMiddleware) isRevoked(ctx context.Context, claims *utils.Claims) (bool, error) {
+	if claims.APIKeyID != "" {
+		if _, err := m.apiKeys.Get(ctx, claims.APIKeyID); err != nil {
+			if errors.Is(err, models.ErrAPIKeyNotFound) {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+	if claims.ID != "" {
+		revoked, err := m.denylist.IsRevoked(ctx, claims.ID, claims.ExpiresAt.Time)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	if claims.FamilyID != "" {
+		revoked, err := m.denylist.IsSessionRevoked(ctx, claims.FamilyID, claims.ExpiresAt.Time)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	if claims.UserID != "" && claims.IssuedAt != nil {
+		return m.denylist.IsUserRevoked(ctx, claims.UserID, claims.IssuedAt.Time)
+	}
+	return false, nil
+}
+
+// authenticateAPIKey authenticates the request as the owner of key. Keys carry
+// no roles and grant only those of their scopes the owner still has, so
+// revoking a role also narrows the owner's keys.
+func (m *AuthMiddleware) authenticateAPIKey(c *gin.Context, key string) {
+	apiKey, err := m.apiKeys.Authenticate(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, models.ErrAPIKeyNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid API key",
+			})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to check API key",
+		})
+		return
+	}
+
+	// Keys of deleted users stop working; banned users cannot use their keys
+	user, err := m.userStore.GetByID(c.Request.Context(), apiKey.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid API key",
+			})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to check API key",
+		})
+		return
+	}
+	if user.Banned {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "user is banned",
+		})
+		return
+	}
+	granted := m.jwtManager.ScopesFor(user.Roles)
+	scopes := slices.DeleteFunc(slices.Clone(apiKey.Scopes), func(scope string) bool {
+		return !slices.Contains(granted, scope)
+	})
+
+	c.Set("userID", user.ID)
+	c.Set("apiKeyID", apiKey.ID)
+	c.Set("scopes", scopes)
+
+	c.Next()
+}
+
+// apiKeyFromRequest returns the API key sent as X-API-Key or as
+// Authorization: ApiKey {key}, if any
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "ApiKey "); ok {
+		return key
+	}
+	return ""
+}
+
+// RequireUser is a middleware that turns away tokens of OAuth2 clients acting
+// for themselves, for routes about the current user. It must run after
+// AuthRequired.
+func (m *AuthMiddleware) RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("userID") == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "client tokens cannot be used here",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSession is a middleware that lets only access tokens from a user's
+// own login session through, for routes that manage the account rather than
+// use its APIs. API keys, down-scoped tokens and tokens issued to OAuth2
+// clients are turned away. It must run after AuthRequired.
+func (m *AuthMiddleware) RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reason string
+		switch {
+		case c.GetBool("downscoped"):
+			reason = "down-scoped tokens cannot be used here"
+		case c.GetString("apiKeyID") != "":
+			reason = "API keys cannot be used here"
+		case c.GetString("clientID") != "":
+			reason = "tokens issued to OAuth clients cannot be used here"
+		case c.GetString("sessionID") == "":
+			reason = "requires an access token from a login session"
+		default:
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": reason,
+		})
+	}
+}
+
+// RequireRole is a middleware that lets only users with role through. It
+// must run after AuthRequired.
+func (m *AuthMiddleware) RequireRole(role string) gin.HandlerFunc {
+	return m.RequireAnyRole(role)
+}
+
+// RequireAnyRole is a middleware that lets only users with at least one of
+// roles through. It must run after AuthRequired.
+func (m *AuthMiddleware) RequireAnyRole(roles ...string) gin.HandlerFunc {
+	required := strings.Join(roles, " or ")
+	return func(c *gin.Context) {
+		userRoles := c.GetStringSlice("roles")
+		for _, role := range roles {
+			if slices.Contains(userRoles, role) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "requires the " + required + " role",
+		})
+	}
+}
+
+// RequireScope is a middleware that lets only tokens granting scope through.
+// It must run after AuthRequired.
+func (m *AuthMiddleware) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(c.GetStringSlice("scopes"), scope) {
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "requires the " + scope + " scope",
+		})
+	}
+}
+
 // UserContext is a key type for context values
 type UserContext string
 
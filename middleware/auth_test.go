@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/LIUHUANUCAS/auth/models"
+	"github.com/LIUHUANUCAS/auth/utils"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestMiddleware returns an AuthMiddleware over the memory user store and
+// an in-process Redis, together with its stores
+func newTestMiddleware(t *testing.T) (*AuthMiddleware, *utils.JWTManager, *models.APIKeyStore, *models.MemoryUserStore) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	cfg := config.Default()
+	cfg.JWT.SecretKey = "0123456789abcdef0123456789abcdef"
+	cfg.JWT.DenylistCacheTTL = 0
+	cfg.JWT.Scopes = []string{config.ScopeFortuneRead}
+	cfg.JWT.RoleScopes = map[string][]string{models.RoleStaff: {config.ScopeHouseRead}}
+	jwtManager, err := utils.NewJWTManager(&cfg.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeys := models.NewAPIKeyStore(redisClient)
+	userStore := models.NewMemoryUserStore()
+	denylist := models.NewTokenDenylist(redisClient, cfg.JWT.DenylistCacheTTL)
+	return NewAuthMiddleware(jwtManager, denylist, apiKeys, userStore), jwtManager, apiKeys, userStore
+}
+
+// request runs handlers on a GET request carrying header and returns the recorded response
+func request(header http.Header, handlers ...gin.HandlerFunc) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.GET("/", append(handlers, func(c *gin.Context) { c.Status(http.StatusNoContent) })...)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = header
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// withContext sets the values AuthRequired would have set
+func withContext(values map[string]any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for key, value := range values {
+			c.Set(key, value)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	m, _, _, _ := newTestMiddleware(t)
+	scopes := withContext(map[string]any{"scopes": []string{config.ScopeFortuneRead}})
+
+	if w := request(http.Header{}, scopes, m.RequireScope(config.ScopeFortuneRead)); w.Code != http.StatusNoContent {
+		t.Errorf("granted scope: status %d", w.Code)
+	}
+	w := request(http.Header{}, scopes, m.RequireScope(config.ScopeHouseRead))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("missing scope: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if got, want := w.Header().Get("WWW-Authenticate"), `Bearer error="insufficient_scope", scope="house:read"`; got != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	m, _, _, _ := newTestMiddleware(t)
+	tests := []struct {
+		name   string
+		values map[string]any
+		want   int
+	}{
+		{"session", map[string]any{"sessionID": "s1"}, http.StatusNoContent},
+		{"no session", map[string]any{}, http.StatusForbidden},
+		{"API key", map[string]any{"apiKeyID": "k1"}, http.StatusForbidden},
+		{"OAuth client", map[string]any{"sessionID": "s1", "clientID": "c1"}, http.StatusForbidden},
+		{"down-scoped", map[string]any{"sessionID": "s1", "downscoped": true}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(http.Header{}, withContext(tt.values), m.RequireSession()); w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthRequiredDownscopedAPIKeyToken(t *testing.T) {
+	ctx := context.Background()
+	m, jwtManager, apiKeys, userStore := newTestMiddleware(t)
+	user := &models.User{Username: "batch"}
+	if err := userStore.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	_, apiKey, err := apiKeys.Create(ctx, user.ID, "nightly", []string{config.ScopeFortuneRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwtManager.GenerateAccessToken(utils.Claims{
+		UserID:     user.ID,
+		Scope:      config.ScopeFortuneRead,
+		Downscoped: true,
+		APIKeyID:   apiKey.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	if w := request(header, m.AuthRequired(), m.RequireScope(config.ScopeFortuneRead)); w.Code != http.StatusNoContent {
+		t.Errorf("while the key exists: status %d, %s", w.Code, w.Body)
+	}
+	if w := request(header, m.AuthRequired(), m.RequireSession()); w.Code != http.StatusForbidden {
+		t.Errorf("account route: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if err := apiKeys.Delete(ctx, user.ID, apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(header, m.AuthRequired()); w.Code != http.StatusUnauthorized {
+		t.Errorf("after the key was revoked: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthRequiredAPIKey(t *testing.T) {
+	ctx := context.Background()
+	m, _, apiKeys, userStore := newTestMiddleware(t)
+	user := &models.User{Username: "batch", Roles: []string{models.RoleStaff}}
+	if err := userStore.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := apiKeys.Create(ctx, user.ID, "nightly", []string{config.ScopeFortuneRead, config.ScopeHouseRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"X-Api-Key": {key}}
+	house := []gin.HandlerFunc{m.AuthRequired(), m.RequireScope(config.ScopeHouseRead)}
+	fortune := []gin.HandlerFunc{m.AuthRequired(), m.RequireScope(config.ScopeFortuneRead)}
+
+	if w := request(header, house...); w.Code != http.StatusNoContent {
+		t.Errorf("scope of the owner's role: status %d, %s", w.Code, w.Body)
+	}
+	if w := request(http.Header{"X-Api-Key": {key + "x"}}, m.AuthRequired()); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Taking the role away narrows the key to the scopes the owner still has
+	if _, err := userStore.RevokeRole(ctx, user.ID, models.RoleStaff); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(header, house...); w.Code != http.StatusForbidden {
+		t.Errorf("scope of a revoked role: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := request(header, fortune...); w.Code != http.StatusNoContent {
+		t.Errorf("scope every user has: status %d, %s", w.Code, w.Body)
+	}
+
+	user.Banned = true
+	if err := userStore.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(header, fortune...); w.Code != http.StatusForbidden {
+		t.Errorf("banned owner: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if err := userStore.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(header, fortune...); w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted owner: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrAPIKeyNotFound is returned when an API key does not exist, has been
+// revoked or does not match its stored hash
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyPrefix starts every API key, so keys are easy to recognise in
+// configs, logs and secret scanners
+const APIKeyPrefix = "ak_"
+
+// apiKeyTouchInterval is how often a key's last used time is written, so
+// busy keys do not cost a Redis write per request
+const apiKeyTouchInterval = time.Minute
+
+// APIKey is a long-lived credential for a machine client acting as a user or
+// service account. Only a hash of the key itself is stored.
+type APIKey struct {
+	ID string `json:"id"`
+	// Prefix is the start of the key, enough to tell keys apart without revealing them
+	Prefix     string    `json:"prefix"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+}
+
+// storedAPIKey is an API key as stored in Redis
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// APIKeyStore handles API key storage operations
+type APIKeyStore struct {
+	client *redis.Client
+}
+
+// NewAPIKeyStore creates a new APIKeyStore
+func NewAPIKeyStore(client *redis.Client) *APIKeyStore {
+	return &APIKeyStore{
+		client: client,
+	}
+}
+
+// Create generates a new API key for userID and stores its hash. It returns
+// the key, which cannot be retrieved again, and its record.
+func (s *APIKeyStore) Create(ctx context.Context, userID, name string, scopes []string) (string, *APIKey, error) {
+	if userID == "" {
+		return "", nil, errors.New("user ID cannot be empty")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	apiKey := &APIKey{
+		ID:        hex.EncodeToString(id),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	apiKey.Prefix = APIKeyPrefix + apiKey.ID
+	key := apiKey.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	keyJSON, err := json.Marshal(storedAPIKey{APIKey: *apiKey, Hash: hashSecret(key)})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal API key: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, apiKeyKey(apiKey.ID), keyJSON, 0)
+		pipe.SAdd(ctx, userAPIKeysKey(userID), apiKey.ID)
+		return nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return key, apiKey, nil
+}
+
+// Get retrieves an API key's record by ID
+func (s *APIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &stored.APIKey, nil
+}
+
+// Authenticate returns the record of key and records that it was used
+func (s *APIKeyStore) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashSecret(key))) != 1 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	now := time.Now()
+	if now.Sub(stored.LastUsedAt) >= apiKeyTouchInterval {
+		stored.LastUsedAt = now
+		keyJSON, err := json.Marshal(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal API key: %w", err)
+		}
+		// Only overwrite a key that still exists, so a concurrent revocation sticks
+		if err := s.client.SetXX(ctx, apiKeyKey(id), keyJSON, redis.KeepTTL).Err(); err != nil {
+			return nil, fmt.Errorf("failed to record API key use: %w", err)
+		}
+	}
+
+	return &stored.APIKey, nil
+}
+
+// ListByUser returns the user's API keys, newest first. Keys that no longer
+// exist are pruned from the index as they are found.
+func (s *APIKeyStore) ListByUser(ctx context.Context, userID string) ([]*APIKey, error) {
+	indexKey := userAPIKeysKey(userID)
+	ids, err := s.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+
+	apiKeys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		apiKey, err := s.Get(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				s.client.SRem(ctx, indexKey, id)
+				continue
+			}
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].CreatedAt.After(apiKeys[j].CreatedAt)
+	})
+
+	return apiKeys, nil
+}
+
+// Delete revokes an API key and removes it from the user's index
+func (s *APIKeyStore) Delete(ctx context.Context, userID, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, apiKeyKey(id))
+		pipe.SRem(ctx, userAPIKeysKey(userID), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	return nil
+}
+
+// ReassignUser moves every API key of oldUserID to newUserID, used when a
+// user's ID is migrated
+func (s *APIKeyStore) ReassignUser(ctx context.Context, oldUserID, newUserID string) error {
+	oldKey := userAPIKeysKey(oldUserID)
+	ids, err := s.client.SMembers(ctx, oldKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list API keys: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, id := range ids {
+		stored, err := s.get(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		stored.UserID = newUserID
+		keyJSON, err := json.Marshal(stored)
+		if err != nil {
+			return fmt.Errorf("failed to marshal API key: %w", err)
+		}
+		if err := s.client.Set(ctx, apiKeyKey(id), keyJSON, redis.KeepTTL).Err(); err != nil {
+			return fmt.Errorf("failed to update API key: %w", err)
+		}
+	}
+
+	newKey := userAPIKeysKey(newUserID)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SUnionStore(ctx, newKey, newKey, oldKey)
+		pipe.Del(ctx, oldKey)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move API key index: %w", err)
+	}
+
+	return nil
+}
+
+func (s *APIKeyStore) get(ctx context.Context, id string) (*storedAPIKey, error) {
+	keyJSON, err := s.client.Get(ctx, apiKeyKey(id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	var stored storedAPIKey
+	if err := json.Unmarshal([]byte(keyJSON), &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API key: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// hashSecret hashes a generated secret, such as an API key, for storage.
+// Generated secrets are random and long, so a fast hash is enough, unlike for
+// passwords.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyKey(id string) string {
+	return fmt.Sprintf("api_key:%s", id)
+}
+
+func userAPIKeysKey(userID string) string {
+	return fmt.Sprintf("user_api_keys:%s", userID)
+}
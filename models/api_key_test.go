@@ -0,0 +1,39 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAPIKeyStoreReassignUser(t *testing.T) {
+	ctx := context.Background()
+	store := NewAPIKeyStore(newTestRedis(t))
+	key, apiKey, err := store.Create(ctx, "alice", "nightly", []string{"fortune:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.ReassignUser(ctx, "alice", "0199ea7c-0000-7000-8000-000000000001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := store.ListByUser(ctx, "alice"); err != nil || len(keys) != 0 {
+		t.Errorf("keys of the old ID = %v, %v, want none", keys, err)
+	}
+	keys, err := store.ListByUser(ctx, "0199ea7c-0000-7000-8000-000000000001")
+	if err != nil || len(keys) != 1 || keys[0].ID != apiKey.ID {
+		t.Fatalf("keys of the new ID = %v, %v, want %s", keys, err, apiKey.ID)
+	}
+	authenticated, err := store.Authenticate(ctx, key)
+	if err != nil || authenticated.UserID != "0199ea7c-0000-7000-8000-000000000001" {
+		t.Errorf("Authenticate after reassigning = %v, %v, want the new owner", authenticated, err)
+	}
+
+	if err := store.Delete(ctx, "0199ea7c-0000-7000-8000-000000000001", apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Authenticate(ctx, key); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Authenticate after Delete = %v, want ErrAPIKeyNotFound", err)
+	}
+}
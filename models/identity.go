@@ -0,0 +1,319 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/config"
+)
+
+const (
+	// IdentityWeChat is the provider of identities from the default WeChat app,
+	// whose subject is the OpenID. See WeChatIdentityProvider for other apps.
+	IdentityWeChat = "wechat"
+	// IdentityPhone is the provider of verified phone numbers, whose subject is the E.164 number
+	IdentityPhone = "phone"
+)
+
+// Usernames of users created at WeChat or phone login start with these
+// prefixes and a random suffix. They are reserved, so nobody can register a
+// username a login is about to create.
+const (
+	WeChatUsernamePrefix = "wx_"
+	PhoneUsernamePrefix  = "phone_"
+)
+
+// usernameAttempts bounds how often a login picks another generated username
+// after a collision
+const usernameAttempts = 5
+
+// IsReservedUsername reports whether username has a prefix reserved for
+// generated usernames
+func IsReservedUsername(username string) bool {
+	return strings.HasPrefix(username, WeChatUsernamePrefix) || strings.HasPrefix(username, PhoneUsernamePrefix)
+}
+
+var (
+	// ErrIdentityTaken is returned when an identity is already linked to another user
+	ErrIdentityTaken = errors.New("identity already linked to another user")
+	// ErrIdentityNotFound is returned when a user has no identity from a provider
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrProviderLinked is returned when a user already has a different identity from a provider
+	ErrProviderLinked = errors.New("provider already linked")
+	// ErrLastLoginMethod is returned when unlinking would leave a user unable to log in
+	ErrLastLoginMethod = errors.New("cannot remove the last login method")
+)
+
+// Identity is an external account a user can log in with. A user has at most
+// one identity per provider, and an identity belongs to at most one user.
+type Identity struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	LinkedAt time.Time `json:"linked_at"`
+
+	// UnionID is the WeChat Open Platform UnionID, the same for one person
+	// across all apps of the platform. A UnionID belongs to at most one user.
+	UnionID string `json:"union_id,omitempty"`
+}
+
+// WeChatIdentityProvider returns the identity provider of a WeChat app's
+// users. OpenIDs differ per app, so each app has its own provider, "wechat:"
+// followed by the app name; the default app keeps "wechat" from before
+// apps were configurable.
+func WeChatIdentityProvider(app string) string {
+	if app == config.DefaultWeChatApp {
+		return IdentityWeChat
+	}
+	return IdentityWeChat + ":" + app
+}
+
+// Identity returns the user's identity from provider, or nil if there is none
+func (u *User) Identity(provider string) *Identity {
+	for i := range u.Identities {
+		if u.Identities[i].Provider == provider {
+			return &u.Identities[i]
+		}
+	}
+	return nil
+}
+
+// LoginMethods returns how many ways the user can log in: a password and each identity
+func (u *User) LoginMethods() int {
+	n := len(u.Identities)
+	if u.Password != "" {
+		n++
+	}
+	return n
+}
+
+// hasUnionID reports whether any of the user's identities carries unionID
+func (u *User) hasUnionID(unionID string) bool {
+	for _, identity := range u.Identities {
+		if identity.UnionID == unionID {
+			return true
+		}
+	}
+	return false
+}
+
+// addIdentity links identity to the user. Linking the same identity again
+// only records its UnionID if it was not known yet.
+func (u *User) addIdentity(identity Identity) error {
+	if existing := u.Identity(identity.Provider); existing != nil {
+		if existing.Subject != identity.Subject {
+			return ErrProviderLinked
+		}
+		if existing.UnionID == "" {
+			existing.UnionID = identity.UnionID
+		}
+		return nil
+	}
+
+	if identity.LinkedAt.IsZero() {
+		identity.LinkedAt = time.Now()
+	}
+	u.Identities = append(u.Identities, identity)
+	if field := u.mirror(identity.Provider); field != nil {
+		*field = identity.Subject
+	}
+	return nil
+}
+
+// removeIdentity unlinks the user's identity from provider and returns it
+func (u *User) removeIdentity(provider string) (Identity, error) {
+	for i, identity := range u.Identities {
+		if identity.Provider != provider {
+			continue
+		}
+		if u.LoginMethods() <= 1 {
+			return Identity{}, ErrLastLoginMethod
+		}
+		u.Identities = append(u.Identities[:i:i], u.Identities[i+1:]...)
+		if field := u.mirror(provider); field != nil {
+			*field = ""
+		}
+		return identity, nil
+	}
+	return Identity{}, ErrIdentityNotFound
+}
+
+// mirror returns the User field that mirrors the identity from provider, or
+// nil if there is none
+func (u *User) mirror(provider string) *string {
+	switch provider {
+	case IdentityWeChat:
+		return &u.OpenID
+	case IdentityPhone:
+		return &u.Phone
+	}
+	return nil
+}
+
+// syncIdentities keeps the OpenID and Phone fields in step with their
+// identities. Users stored before identities existed only have OpenID set.
+func (u *User) syncIdentities() {
+	for _, provider := range []string{IdentityWeChat, IdentityPhone} {
+		field := u.mirror(provider)
+		if identity := u.Identity(provider); identity != nil {
+			*field = identity.Subject
+			continue
+		}
+		if *field != "" {
+			u.Identities = append(u.Identities, Identity{
+				Provider: provider,
+				Subject:  *field,
+				LinkedAt: u.CreatedAt,
+			})
+		}
+	}
+}
+
+// indexKeys returns the index keys of all the user's identities and UnionIDs
+func (u *User) indexKeys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, identity := range u.Identities {
+		for _, key := range identity.indexKeys() {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// indexKeys returns the index keys of the identity and of its UnionID
+func (i Identity) indexKeys() []string {
+	keys := []string{identityKey(i.Provider, i.Subject)}
+	if i.UnionID != "" {
+		keys = append(keys, unionIDKey(i.UnionID))
+	}
+	return keys
+}
+
+// identityKey is the Redis index key of an identity. WeChat identities keep
+// the openid: keys that predate identities.
+func identityKey(provider, subject string) string {
+	switch provider {
+	case IdentityWeChat:
+		return fmt.Sprintf("openid:%s", subject)
+	case IdentityPhone:
+		return fmt.Sprintf("phone:%s", subject)
+	}
+	return fmt.Sprintf("identity:%s:%s", provider, subject)
+}
+
+// unionIDKey is the Redis index key of a WeChat UnionID
+func unionIDKey(unionID string) string {
+	return fmt.Sprintf("unionid:%s", unionID)
+}
+
+// FindOrCreateWeChatUser returns the user with the WeChat identity from
+// provider, creating it if needed; CreateWeChatUser is this for Mini Program
+// identities. The user is looked up by UnionID first, so one person maps to
+// one user across WeChat apps, then by OpenID. An existing user gets the
+// identity linked if it was missing, e.g. a UnionID seen for the first time;
+// a user is created only if neither is linked yet.
+func FindOrCreateWeChatUser(ctx context.Context, s UserRepository, provider, openID, unionID string) (*User, error) {
+	if openID == "" {
+		return nil, errors.New("OpenID cannot be empty")
+	}
+	identity := Identity{Provider: provider, Subject: openID, UnionID: unionID, LinkedAt: time.Now()}
+
+	return findOrCreate(ctx, s, identity, WeChatUsernamePrefix, func() (*User, error) {
+		user, err := findWeChatUser(ctx, s, provider, openID, unionID)
+		if err != nil {
+			return nil, err
+		}
+		return linkWeChatIdentity(ctx, s, user, identity)
+	})
+}
+
+// FindOrCreatePhoneUser returns the user with the verified phone number,
+// creating a user that logs in with it if there is none
+func FindOrCreatePhoneUser(ctx context.Context, s UserRepository, phone string) (*User, error) {
+	if phone == "" {
+		return nil, errors.New("phone cannot be empty")
+	}
+	identity := Identity{Provider: IdentityPhone, Subject: phone, LinkedAt: time.Now()}
+
+	return findOrCreate(ctx, s, identity, PhoneUsernamePrefix, func() (*User, error) {
+		return s.GetByIdentity(ctx, IdentityPhone, phone)
+	})
+}
+
+// findOrCreate returns the user found by find, or creates one that logs in
+// with identity and has a generated username starting with usernamePrefix.
+// The username reveals nothing about the identity. If a concurrent login
+// creates the user first, it is looked up again; if the username is taken,
+// another one is picked.
+func findOrCreate(ctx context.Context, s UserRepository, identity Identity, usernamePrefix string, find func() (*User, error)) (*User, error) {
+	lookedUpAgain := false
+	for attempt := 1; ; attempt++ {
+		user, err := find()
+		if !errors.Is(err, ErrUserNotFound) {
+			return user, err
+		}
+
+		id, err := NewUserID()
+		if err != nil {
+			return nil, err
+		}
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, fmt.Errorf("failed to generate username: %w", err)
+		}
+		user = &User{
+			ID:         id,
+			Username:   usernamePrefix + hex.EncodeToString(suffix),
+			Identities: []Identity{identity},
+		}
+		err = s.Create(ctx, user)
+		switch {
+		case err == nil:
+			return user, nil
+		case errors.Is(err, ErrIdentityTaken) && !lookedUpAgain:
+			// Created by a concurrent login, find it
+			lookedUpAgain = true
+		case errors.Is(err, ErrUsernameTaken) && attempt < usernameAttempts:
+			// Try another username
+		default:
+			return nil, err
+		}
+	}
+}
+
+// findWeChatUser looks a WeChat user up by UnionID, falling back to the
+// provider's OpenID
+func findWeChatUser(ctx context.Context, s UserRepository, provider, openID, unionID string) (*User, error) {
+	if unionID != "" {
+		user, err := s.GetByUnionID(ctx, unionID)
+		if !errors.Is(err, ErrUserNotFound) {
+			return user, err
+		}
+	}
+	return s.GetByIdentity(ctx, provider, openID)
+}
+
+// linkWeChatIdentity links identity to a user found at WeChat login if it is
+// not linked yet. When that is impossible, because the user already has
+// another WeChat identity or the UnionID belongs to another user, the user
+// is returned unchanged.
+func linkWeChatIdentity(ctx context.Context, s UserRepository, user *User, identity Identity) (*User, error) {
+	existing := user.Identity(identity.Provider)
+	if existing != nil && existing.Subject == identity.Subject && (identity.UnionID == "" || existing.UnionID != "") {
+		return user, nil
+	}
+
+	linked, err := s.LinkIdentity(ctx, user.ID, identity)
+	if errors.Is(err, ErrIdentityTaken) || errors.Is(err, ErrProviderLinked) {
+		return user, nil
+	}
+	return linked, err
+}
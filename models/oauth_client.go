@@ -0,0 +1,185 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrOAuthClientNotFound is returned when an OAuth2 client is not registered
+// or its secret does not match
+var ErrOAuthClientNotFound = errors.New("OAuth client not found")
+
+// OAuthClient is a registered OAuth2 client, such as a service getting tokens
+// with the client credentials grant or a web app signing users in with the
+// authorization code grant. Only a hash of its secret is stored.
+type OAuthClient struct {
+	ID   string `json:"client_id"`
+	Name string `json:"name"`
+	// Scopes are the scopes the client may ask for
+	Scopes []string `json:"scopes"`
+	// RedirectURIs are where users may be sent back to with an authorization code
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+	// Public clients, such as single page apps, cannot keep a secret. They
+	// have none and can only use the authorization code grant.
+	Public bool `json:"public,omitempty"`
+	// FirstParty clients are our own apps. Users are not asked to consent to
+	// them and get the same tokens as when logging in directly.
+	FirstParty bool      `json:"first_party,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// storedOAuthClient is an OAuth2 client as stored in Redis
+type storedOAuthClient struct {
+	OAuthClient
+	SecretHash string `json:"secret_hash"`
+}
+
+// OAuthClientStore handles OAuth2 client storage operations
+type OAuthClientStore struct {
+	client *redis.Client
+}
+
+// NewOAuthClientStore creates a new OAuthClientStore
+func NewOAuthClientStore(client *redis.Client) *OAuthClientStore {
+	return &OAuthClientStore{
+		client: client,
+	}
+}
+
+// Create registers client, filling in a generated ID and, unless it is
+// public, a secret. It returns the secret, which cannot be retrieved again.
+func (s *OAuthClientStore) Create(ctx context.Context, client *OAuthClient) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate client ID: %w", err)
+	}
+	client.ID = hex.EncodeToString(id)
+	client.CreatedAt = time.Now()
+
+	stored := storedOAuthClient{OAuthClient: *client}
+	var clientSecret string
+	if !client.Public {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return "", fmt.Errorf("failed to generate client secret: %w", err)
+		}
+		clientSecret = base64.RawURLEncoding.EncodeToString(secret)
+		stored.SecretHash = hashSecret(clientSecret)
+	}
+
+	clientJSON, err := json.Marshal(stored)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal OAuth client: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, oauthClientKey(client.ID), clientJSON, 0)
+		pipe.SAdd(ctx, oauthClientsKey, client.ID)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store OAuth client: %w", err)
+	}
+
+	return clientSecret, nil
+}
+
+// Get retrieves a client by ID
+func (s *OAuthClientStore) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &stored.OAuthClient, nil
+}
+
+// Authenticate returns the client with id if secret is its secret. Public
+// clients have no secret and never authenticate.
+func (s *OAuthClientStore) Authenticate(ctx context.Context, id, secret string) (*OAuthClient, error) {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Public || subtle.ConstantTimeCompare([]byte(stored.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrOAuthClientNotFound
+	}
+	return &stored.OAuthClient, nil
+}
+
+// List returns every registered client, oldest first
+func (s *OAuthClientStore) List(ctx context.Context) ([]*OAuthClient, error) {
+	ids, err := s.client.SMembers(ctx, oauthClientsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list OAuth clients: %w", err)
+	}
+
+	clients := make([]*OAuthClient, 0, len(ids))
+	for _, id := range ids {
+		client, err := s.Get(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrOAuthClientNotFound) {
+				s.client.SRem(ctx, oauthClientsKey, id)
+				continue
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+	})
+
+	return clients, nil
+}
+
+// Delete removes a client. Tokens already issued to it stay valid until they expire.
+func (s *OAuthClientStore) Delete(ctx context.Context, id string) error {
+	var del *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, oauthClientKey(id))
+		pipe.SRem(ctx, oauthClientsKey, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete OAuth client: %w", err)
+	}
+	if del.Val() == 0 {
+		return ErrOAuthClientNotFound
+	}
+	return nil
+}
+
+func (s *OAuthClientStore) get(ctx context.Context, id string) (*storedOAuthClient, error) {
+	clientJSON, err := s.client.Get(ctx, oauthClientKey(id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrOAuthClientNotFound
+		}
+		return nil, fmt.Errorf("failed to get OAuth client: %w", err)
+	}
+
+	var stored storedOAuthClient
+	if err := json.Unmarshal([]byte(clientJSON), &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal OAuth client: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// oauthClientsKey indexes the IDs of every registered client
+const oauthClientsKey = "oauth_clients"
+
+func oauthClientKey(id string) string {
+	return fmt.Sprintf("oauth_client:%s", id)
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrOAuthCodeNotFound is returned when an authorization code is unknown,
+// expired or already used
+var ErrOAuthCodeNotFound = errors.New("authorization code not found")
+
+// OAuthCode is what a user authorized a client to do with an authorization code
+type OAuthCode struct {
+	ClientID    string `json:"client_id"`
+	UserID      string `json:"user_id"`
+	RedirectURI string `json:"redirect_uri"`
+	// Scope is the space separated list of scopes the user consented to
+	Scope string `json:"scope"`
+	// CodeChallenge is the client's PKCE S256 code challenge
+	CodeChallenge string `json:"code_challenge"`
+}
+
+// OAuthCodeUse records the session an authorization code was exchanged for,
+// so the session can be revoked if the code is replayed
+type OAuthCodeUse struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+// OAuthCodeStore keeps authorization codes for ttl or until they are
+// exchanged for tokens, which can happen only once
+type OAuthCodeStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewOAuthCodeStore creates a new OAuthCodeStore
+func NewOAuthCodeStore(client *redis.Client, ttl time.Duration) *OAuthCodeStore {
+	return &OAuthCodeStore{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+// Save records the authorization behind code
+func (s *OAuthCodeStore) Save(ctx context.Context, code string, authorization *OAuthCode) error {
+	data, err := json.Marshal(authorization)
+	if err != nil {
+		return fmt.Errorf("failed to marshal authorization code: %w", err)
+	}
+	if err := s.client.Set(ctx, oauthCodeKey(code), data, s.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store authorization code: %w", err)
+	}
+	return nil
+}
+
+// Consume removes code and returns the authorization it was saved for
+func (s *OAuthCodeStore) Consume(ctx context.Context, code string) (*OAuthCode, error) {
+	data, err := s.client.GetDel(ctx, oauthCodeKey(code)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrOAuthCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to get authorization code: %w", err)
+	}
+
+	var authorization OAuthCode
+	if err := json.Unmarshal(data, &authorization); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal authorization code: %w", err)
+	}
+
+	return &authorization, nil
+}
+
+// MarkUsed records the session code was exchanged for, for as long as the
+// code could have lived
+func (s *OAuthCodeStore) MarkUsed(ctx context.Context, code string, use *OAuthCodeUse) error {
+	data, err := json.Marshal(use)
+	if err != nil {
+		return fmt.Errorf("failed to marshal authorization code use: %w", err)
+	}
+	if err := s.client.Set(ctx, oauthCodeUsedKey(code), data, s.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store authorization code use: %w", err)
+	}
+	return nil
+}
+
+// Use returns the session code was exchanged for, or ErrOAuthCodeNotFound if
+// it has not been used or its use is no longer remembered
+func (s *OAuthCodeStore) Use(ctx context.Context, code string) (*OAuthCodeUse, error) {
+	data, err := s.client.Get(ctx, oauthCodeUsedKey(code)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrOAuthCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to get authorization code use: %w", err)
+	}
+
+	var use OAuthCodeUse
+	if err := json.Unmarshal(data, &use); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal authorization code use: %w", err)
+	}
+	return &use, nil
+}
+
+func oauthCodeKey(code string) string {
+	return fmt.Sprintf("oauth_code:%s", code)
+}
+
+func oauthCodeUsedKey(code string) string {
+	return fmt.Sprintf("oauth_code_used:%s", code)
+}
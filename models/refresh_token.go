@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrRefreshTokenNotFound is returned when a refresh token is not active,
+// either because it expired, was logged out or was already rotated
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// RefreshTokenStore tracks active refresh tokens and their token families.
+// Every refresh replaces the family's token with a new one, so a family has
+// exactly one active token at a time.
+type RefreshTokenStore struct {
+	client *redis.Client
+}
+
+// NewRefreshTokenStore creates a new RefreshTokenStore
+func NewRefreshTokenStore(client *redis.Client) *RefreshTokenStore {
+	return &RefreshTokenStore{
+		client: client,
+	}
+}
+
+// Store records token as the active refresh token of its family
+func (s *RefreshTokenStore) Store(ctx context.Context, token, userID, familyID string, ttl time.Duration) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, refreshTokenKey(token), userID, ttl)
+		pipe.Set(ctx, refreshFamilyKey(familyID), token, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return nil
+}
+
+// Consume atomically removes an active refresh token and returns its user ID.
+// Only one caller can consume a given token; everyone else gets ErrRefreshTokenNotFound.
+func (s *RefreshTokenStore) Consume(ctx context.Context, token string) (string, error) {
+	userID, err := s.client.GetDel(ctx, refreshTokenKey(token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", ErrRefreshTokenNotFound
+		}
+		return "", fmt.Errorf("failed to consume refresh token: %w", err)
+	}
+	return userID, nil
+}
+
+// Delete removes a single refresh token
+func (s *RefreshTokenStore) Delete(ctx context.Context, token string) error {
+	if err := s.client.Del(ctx, refreshTokenKey(token)).Err(); err != nil {
+		return fmt.Errorf("failed to delete refresh token: %w", err)
+	}
+	return nil
+}
+
+// RevokeFamily removes a token family together with its active refresh token
+func (s *RefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	familyKey := refreshFamilyKey(familyID)
+	token, err := s.client.GetDel(ctx, familyKey).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+
+	return s.Delete(ctx, token)
+}
+
+func refreshTokenKey(token string) string {
+	return fmt.Sprintf("refresh_token:%s", token)
+}
+
+func refreshFamilyKey(familyID string) string {
+	return fmt.Sprintf("refresh_family:%s", familyID)
+}
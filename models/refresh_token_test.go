@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenStoreConsume(t *testing.T) {
+	ctx := context.Background()
+	store := NewRefreshTokenStore(newTestRedis(t))
+	if err := store.Store(ctx, "token1", "alice", "family1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := store.Consume(ctx, "token1")
+	if err != nil || userID != "alice" {
+		t.Fatalf("Consume = %q, %v, want alice", userID, err)
+	}
+	// A rotated token can only be used once
+	if _, err := store.Consume(ctx, "token1"); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("second Consume = %v, want ErrRefreshTokenNotFound", err)
+	}
+	if _, err := store.Consume(ctx, "unknown"); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("Consume of an unknown token = %v, want ErrRefreshTokenNotFound", err)
+	}
+}
+
+func TestRefreshTokenStoreRevokeFamily(t *testing.T) {
+	ctx := context.Background()
+	store := NewRefreshTokenStore(newTestRedis(t))
+	if err := store.Store(ctx, "token1", "alice", "family1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Consume(ctx, "token1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(ctx, "token2", "alice", "family1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(ctx, "other", "alice", "family2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reusing token1 revokes its family, which takes the token it was rotated into
+	if err := store.RevokeFamily(ctx, "family1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Consume(ctx, "token2"); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("Consume of the family's active token = %v, want ErrRefreshTokenNotFound", err)
+	}
+	if _, err := store.Consume(ctx, "other"); err != nil {
+		t.Errorf("Consume of another family's token = %v", err)
+	}
+	if err := store.RevokeFamily(ctx, "family1"); err != nil {
+		t.Errorf("revoking a revoked family = %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"slices"
+	"sort"
+)
+
+const (
+	// RoleAdmin may manage users and grant and revoke roles
+	RoleAdmin = "admin"
+	// RoleStaff may look up users to support them
+	RoleStaff = "staff"
+)
+
+// Roles lists the roles that can be granted
+var Roles = []string{RoleAdmin, RoleStaff}
+
+// IsValidRole reports whether role is one of Roles
+func IsValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// HasRole reports whether the user has role
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// addRole gives the user role, reporting whether it is new
+func (u *User) addRole(role string) bool {
+	if u.HasRole(role) {
+		return false
+	}
+	u.Roles = append(u.Roles, role)
+	sort.Strings(u.Roles)
+	return true
+}
+
+// removeRole takes role from the user, reporting whether they had it
+func (u *User) removeRole(role string) bool {
+	i := slices.Index(u.Roles, role)
+	if i < 0 {
+		return false
+	}
+	u.Roles = slices.Delete(u.Roles, i, i+1)
+	return true
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrSessionNotFound is returned when a session does not exist or has expired
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a logged in device. Its ID is the refresh token family ID, so a
+// session lives as long as its refresh tokens keep being rotated.
+type Session struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	// ClientID is the OAuth2 client the user signed in to, if any
+	ClientID   string    `json:"client_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// SessionStore handles session storage operations
+type SessionStore struct {
+	client *redis.Client
+}
+
+// NewSessionStore creates a new SessionStore
+func NewSessionStore(client *redis.Client) *SessionStore {
+	return &SessionStore{
+		client: client,
+	}
+}
+
+// Create stores a new session and adds it to the user's session index
+func (s *SessionStore) Create(ctx context.Context, session *Session, ttl time.Duration) error {
+	if session.ID == "" || session.UserID == "" {
+		return errors.New("session ID and user ID cannot be empty")
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastUsedAt = now
+
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	indexKey := userSessionsKey(session.UserID)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(session.ID), sessionJSON, ttl)
+		pipe.SAdd(ctx, indexKey, session.ID)
+		pipe.Expire(ctx, indexKey, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+
+	return nil
+}
+
+// Get retrieves a session by ID
+func (s *SessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	sessionJSON, err := s.client.Get(ctx, sessionKey(id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+
+	return &session, nil
+}
+
+// Touch records that a session was used and extends its lifetime
+func (s *SessionStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	session, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	session.LastUsedAt = time.Now()
+
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	indexKey := userSessionsKey(session.UserID)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(id), sessionJSON, ttl)
+		pipe.Expire(ctx, indexKey, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+
+	return nil
+}
+
+// ListByUser returns the user's sessions, most recently used first.
+// Expired sessions are pruned from the index as they are found.
+func (s *SessionStore) ListByUser(ctx context.Context, userID string) ([]*Session, error) {
+	indexKey := userSessionsKey(userID)
+	ids, err := s.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.Get(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				s.client.SRem(ctx, indexKey, id)
+				continue
+			}
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// Delete removes a session and its entry in the user's session index
+func (s *SessionStore) Delete(ctx context.Context, userID, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(userID), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// ReassignUser moves every session of oldUserID to newUserID, used when a
+// user's ID is migrated. ttl is the lifetime of the new session index.
+func (s *SessionStore) ReassignUser(ctx context.Context, oldUserID, newUserID string, ttl time.Duration) error {
+	sessions, err := s.ListByUser(ctx, oldUserID)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	for _, session := range sessions {
+		session.UserID = newUserID
+		sessionJSON, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("failed to marshal session: %w", err)
+		}
+		if err := s.client.Set(ctx, sessionKey(session.ID), sessionJSON, redis.KeepTTL).Err(); err != nil {
+			return fmt.Errorf("failed to update session: %w", err)
+		}
+	}
+
+	oldKey := userSessionsKey(oldUserID)
+	newKey := userSessionsKey(newUserID)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SUnionStore(ctx, newKey, newKey, oldKey)
+		pipe.Expire(ctx, newKey, ttl)
+		pipe.Del(ctx, oldKey)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move session index: %w", err)
+	}
+
+	return nil
+}
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("session:%s", id)
+}
+
+func userSessionsKey(userID string) string {
+	return fmt.Sprintf("user_sessions:%s", userID)
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewSessionStore(newTestRedis(t))
+	for _, id := range []string{"phone", "laptop"} {
+		if err := store.Create(ctx, &Session{ID: id, UserID: "alice"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Create(ctx, &Session{ID: "other", UserID: "bob"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := store.Touch(ctx, "phone", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.ListByUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "phone" || sessions[1].ID != "laptop" {
+		t.Fatalf("ListByUser = %v, want phone, the most recently used, then laptop", sessions)
+	}
+
+	if err := store.Delete(ctx, "alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "phone"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrSessionNotFound", err)
+	}
+	if sessions, err := store.ListByUser(ctx, "alice"); err != nil || len(sessions) != 1 || sessions[0].ID != "laptop" {
+		t.Errorf("ListByUser after Delete = %v, %v, want laptop", sessions, err)
+	}
+	if err := store.Touch(ctx, "phone", time.Hour); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Touch after Delete = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestSessionStoreReassignUser(t *testing.T) {
+	ctx := context.Background()
+	store := NewSessionStore(newTestRedis(t))
+	if err := store.Create(ctx, &Session{ID: "phone", UserID: "alice"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.ReassignUser(ctx, "alice", "0199ea7c-0000-7000-8000-000000000001", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions, err := store.ListByUser(ctx, "alice"); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions of the old ID = %v, %v, want none", sessions, err)
+	}
+	sessions, err := store.ListByUser(ctx, "0199ea7c-0000-7000-8000-000000000001")
+	if err != nil || len(sessions) != 1 || sessions[0].UserID != "0199ea7c-0000-7000-8000-000000000001" {
+		t.Errorf("sessions of the new ID = %v, %v, want phone", sessions, err)
+	}
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TokenDenylist records revoked token IDs (jti), sessions and users in Redis
+// until the tokens expire. Lookups are cached in process: revoked answers until the
+// token expires, "not revoked" answers for cacheTTL, so a revocation made on
+// another instance takes effect within cacheTTL.
+type TokenDenylist struct {
+	client   *redis.Client
+	cacheTTL time.Duration
+
+	mu        sync.Mutex
+	cache     map[string]denylistEntry
+	lastSweep time.Time
+}
+
+type denylistEntry struct {
+	revoked bool
+	// revokedAt is when a user's tokens were last revoked
+	revokedAt time.Time
+	expiresAt time.Time
+}
+
+// NewTokenDenylist creates a new TokenDenylist
+func NewTokenDenylist(client *redis.Client, cacheTTL time.Duration) *TokenDenylist {
+	return &TokenDenylist{
+		client:   client,
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]denylistEntry),
+	}
+}
+
+// Revoke adds a token ID to the denylist until expiresAt
+func (d *TokenDenylist) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return d.revoke(ctx, revokedTokenKey(jti), expiresAt)
+}
+
+// IsRevoked reports whether a token ID has been revoked. expiresAt is the
+// token's expiry, used to bound how long a revoked answer is cached.
+func (d *TokenDenylist) IsRevoked(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	return d.isRevoked(ctx, revokedTokenKey(jti), expiresAt)
+}
+
+// RevokeSession revokes every access token of a login session, which carry
+// its ID as their fid. ttl is the longest an access token lives; the session
+// cannot issue new ones once its refresh token family is revoked.
+func (d *TokenDenylist) RevokeSession(ctx context.Context, sessionID string, ttl time.Duration) error {
+	return d.revoke(ctx, revokedSessionKey(sessionID), time.Now().Add(ttl))
+}
+
+// IsSessionRevoked reports whether the session an access token belongs to has
+// been revoked. expiresAt is the token's expiry.
+func (d *TokenDenylist) IsSessionRevoked(ctx context.Context, sessionID string, expiresAt time.Time) (bool, error) {
+	return d.isRevoked(ctx, revokedSessionKey(sessionID), expiresAt)
+}
+
+// RevokeUser revokes every access token issued to a user up to now, e.g.
+// after a password change or ban. Tokens are compared by their iat, which has
+// a precision of a millisecond, so tokens issued from the next millisecond on,
+// such as those of a new login, stay valid. ttl is the longest an access
+// token lives.
+func (d *TokenDenylist) RevokeUser(ctx context.Context, userID string, ttl time.Duration) error {
+	now := time.Now()
+	key := revokedUserKey(userID)
+	if err := d.client.Set(ctx, key, now.UnixMilli(), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+
+	d.remember(key, denylistEntry{revoked: true, revokedAt: time.UnixMilli(now.UnixMilli()), expiresAt: now.Add(d.cacheTTL)})
+	return nil
+}
+
+// IsUserRevoked reports whether an access token issued to a user at issuedAt
+// has been revoked with the rest of the user's tokens. Answers are cached for
+// cacheTTL, as a user's tokens can be revoked again later.
+func (d *TokenDenylist) IsUserRevoked(ctx context.Context, userID string, issuedAt time.Time) (bool, error) {
+	now := time.Now()
+	key := revokedUserKey(userID)
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if !ok || !now.Before(entry.expiresAt) {
+		revokedAt, err := d.client.Get(ctx, key).Int64()
+		if err != nil && err != redis.Nil {
+			return false, fmt.Errorf("failed to check token denylist: %w", err)
+		}
+
+		entry = denylistEntry{revoked: err == nil, expiresAt: now.Add(d.cacheTTL)}
+		if entry.revoked {
+			entry.revokedAt = time.UnixMilli(revokedAt)
+		}
+		d.remember(key, entry)
+	}
+
+	return entry.revoked && !issuedAt.After(entry.revokedAt), nil
+}
+
+// revoke denies key until expiresAt
+func (d *TokenDenylist) revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		// Already expired, nothing to deny
+		return nil
+	}
+
+	if err := d.client.Set(ctx, key, 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	d.remember(key, denylistEntry{revoked: true, expiresAt: expiresAt})
+	return nil
+}
+
+// isRevoked reports whether key is denied for a token expiring at expiresAt
+func (d *TokenDenylist) isRevoked(ctx context.Context, key string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.revoked, nil
+	}
+
+	n, err := d.client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check token denylist: %w", err)
+	}
+
+	revoked := n > 0
+	entry = denylistEntry{revoked: revoked, expiresAt: expiresAt}
+	if !revoked && now.Add(d.cacheTTL).Before(expiresAt) {
+		entry.expiresAt = now.Add(d.cacheTTL)
+	}
+	d.remember(key, entry)
+
+	return revoked, nil
+}
+
+// remember caches an answer, dropping expired entries at most once per cacheTTL
+func (d *TokenDenylist) remember(key string, entry denylistEntry) {
+	if d.cacheTTL <= 0 && !entry.revoked {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.cacheTTL {
+		for k, e := range d.cache {
+			if !now.Before(e.expiresAt) {
+				delete(d.cache, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	d.cache[key] = entry
+}
+
+func revokedTokenKey(jti string) string {
+	return fmt.Sprintf("revoked_token:%s", jti)
+}
+
+func revokedSessionKey(sessionID string) string {
+	return fmt.Sprintf("revoked_session:%s", sessionID)
+}
+
+func revokedUserKey(userID string) string {
+	return fmt.Sprintf("revoked_user_tokens:%s", userID)
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis returns a client of an in-process Redis for the test
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestTokenDenylistRevoke(t *testing.T) {
+	ctx := context.Background()
+	d := NewTokenDenylist(newTestRedis(t), time.Minute)
+	expiresAt := time.Now().Add(time.Minute)
+
+	if revoked, err := d.IsRevoked(ctx, "jti1", expiresAt); err != nil || revoked {
+		t.Fatalf("IsRevoked before Revoke = %v, %v", revoked, err)
+	}
+	if err := d.Revoke(ctx, "jti1", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := d.IsRevoked(ctx, "jti1", expiresAt); err != nil || !revoked {
+		t.Errorf("IsRevoked after Revoke = %v, %v", revoked, err)
+	}
+	if revoked, _ := d.IsRevoked(ctx, "jti2", expiresAt); revoked {
+		t.Error("another token is revoked")
+	}
+	// Sessions and tokens are revoked separately
+	if revoked, _ := d.IsSessionRevoked(ctx, "jti1", expiresAt); revoked {
+		t.Error("session with the token's ID is revoked")
+	}
+}
+
+func TestTokenDenylistRevokeSession(t *testing.T) {
+	ctx := context.Background()
+	d := NewTokenDenylist(newTestRedis(t), time.Minute)
+	expiresAt := time.Now().Add(time.Minute)
+
+	if err := d.RevokeSession(ctx, "s1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := d.IsSessionRevoked(ctx, "s1", expiresAt); err != nil || !revoked {
+		t.Errorf("IsSessionRevoked after RevokeSession = %v, %v", revoked, err)
+	}
+	if revoked, _ := d.IsSessionRevoked(ctx, "s2", expiresAt); revoked {
+		t.Error("another session is revoked")
+	}
+}
+
+func TestTokenDenylistSharedAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedis(t)
+	expiresAt := time.Now().Add(time.Minute)
+	a := NewTokenDenylist(client, 0)
+	b := NewTokenDenylist(client, 0)
+
+	if revoked, _ := b.IsRevoked(ctx, "jti1", expiresAt); revoked {
+		t.Fatal("token revoked before Revoke")
+	}
+	if err := a.Revoke(ctx, "jti1", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := b.IsRevoked(ctx, "jti1", expiresAt); !revoked {
+		t.Error("revocation on another instance not seen")
+	}
+}
+
+func TestTokenDenylistRevokeUser(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedis(t)
+	d := NewTokenDenylist(client, time.Minute)
+
+	if revoked, err := d.IsUserRevoked(ctx, "u1", time.Now()); err != nil || revoked {
+		t.Fatalf("IsUserRevoked before RevokeUser = %v, %v", revoked, err)
+	}
+
+	before := time.Now().Add(-time.Millisecond).Truncate(time.Millisecond)
+	if err := d.RevokeUser(ctx, "u1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens carry iat to the millisecond; one issued in the next
+	// millisecond, even within the same second, is not revoked
+	after := time.Now().Add(time.Millisecond).Truncate(time.Millisecond)
+
+	// A fresh instance reads the revocation from Redis rather than its cache
+	for name, d := range map[string]*TokenDenylist{"cached": d, "from Redis": NewTokenDenylist(client, time.Minute)} {
+		if revoked, err := d.IsUserRevoked(ctx, "u1", before); err != nil || !revoked {
+			t.Errorf("%s: token issued before RevokeUser: revoked = %v, %v", name, revoked, err)
+		}
+		if revoked, err := d.IsUserRevoked(ctx, "u1", after); err != nil || revoked {
+			t.Errorf("%s: token issued after RevokeUser: revoked = %v, %v", name, revoked, err)
+		}
+		if revoked, _ := d.IsUserRevoked(ctx, "u2", before); revoked {
+			t.Errorf("%s: another user's token is revoked", name)
+		}
+	}
+}
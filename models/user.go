@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
 // User represents a user in the system
@@ -16,33 +18,151 @@ type User struct {
 	Username  string    `json:"username"`
 	Password  string    `json:"password,omitempty"` // Omit in JSON responses
 	Email     string    `json:"email"`
-	OpenID    string    `json:"open_id,omitempty"` // WeChat OpenID
+	OpenID    string    `json:"open_id,omitempty"` // WeChat OpenID, mirrors the WeChat identity
+	Phone     string    `json:"phone,omitempty"`   // Verified phone number, mirrors the phone identity
+	Nickname  string    `json:"nickname,omitempty"`
+	AvatarURL string    `json:"avatar_url,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Banned    bool      `json:"banned,omitempty"` // Banned users cannot log in or refresh tokens
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	Identities []Identity `json:"identities,omitempty"`
+}
+
+var (
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when creating a user whose ID is already in use
+	ErrUserExists = errors.New("user already exists")
+	// ErrUsernameTaken is returned when creating a user whose username is already in use
+	ErrUsernameTaken = errors.New("username already taken")
+	// ErrOpenIDTaken is returned when creating a user whose WeChat OpenID is already in use.
+	// It is the same error as ErrIdentityTaken.
+	ErrOpenIDTaken = ErrIdentityTaken
+	// ErrEmailTaken is returned by stores that enforce unique emails
+	ErrEmailTaken = errors.New("email already taken")
+)
+
+// UserRepository is the storage interface for users
+type UserRepository interface {
+	// Create stores a new user atomically, returning ErrUsernameTaken,
+	// ErrIdentityTaken or ErrUserExists if it collides with an existing one
+	Create(ctx context.Context, user *User) error
+	// GetByID retrieves a user by ID
+	GetByID(ctx context.Context, id string) (*User, error)
+	// GetByUsername retrieves a user by username
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	// GetByOpenID retrieves a user by WeChat OpenID
+	GetByOpenID(ctx context.Context, openID string) (*User, error)
+	// GetByUnionID retrieves a user by WeChat UnionID
+	GetByUnionID(ctx context.Context, unionID string) (*User, error)
+	// GetByIdentity retrieves a user by a linked identity
+	GetByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	// CreateWeChatUser returns the user with the given UnionID, or OpenID when
+	// unionID is empty or unknown, creating it if needed so concurrent logins
+	// resolve to the same user
+	CreateWeChatUser(ctx context.Context, openID, unionID string) (*User, error)
+	// LinkIdentity attaches an identity to a user and returns the updated user.
+	// It returns ErrIdentityTaken if the identity belongs to another user and
+	// ErrProviderLinked if the user has a different identity from the provider.
+	LinkIdentity(ctx context.Context, userID string, identity Identity) (*User, error)
+	// UnlinkIdentity removes the user's identity from provider and returns the
+	// updated user. It returns ErrLastLoginMethod if the user has no password
+	// and no other identity.
+	UnlinkIdentity(ctx context.Context, userID, provider string) (*User, error)
+	// GrantRole gives a user a role and returns the updated user. Granting a
+	// role the user already has changes nothing.
+	GrantRole(ctx context.Context, userID, role string) (*User, error)
+	// RevokeRole takes a role from a user and returns the updated user.
+	// Revoking a role the user does not have changes nothing.
+	RevokeRole(ctx context.Context, userID, role string) (*User, error)
+	// Update updates an existing user. It does not change linked identities or roles.
+	Update(ctx context.Context, user *User) error
+	// Delete removes a user
+	Delete(ctx context.Context, id string) error
 }
 
-// UserStore handles user storage operations
-type UserStore struct {
+// LegacyIDMigrator is implemented by stores that may hold users created before
+// IDs were generated (username or "wx_<openid>" IDs)
+type LegacyIDMigrator interface {
+	// MigrateLegacyIDs gives every legacy user a generated ID and records the
+	// old ID as an alias so GetByID still resolves it. It returns old -> new IDs.
+	MigrateLegacyIDs(ctx context.Context) (map[string]string, error)
+}
+
+// NewUserID generates an opaque, time ordered user ID (UUIDv7)
+func NewUserID() (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate user ID: %w", err)
+	}
+	return id.String(), nil
+}
+
+// isLegacyID reports whether id predates generated IDs
+func isLegacyID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err != nil
+}
+
+// RedisUserStore is a UserRepository backed by Redis
+type RedisUserStore struct {
 	client *redis.Client
 }
 
-// NewUserStore creates a new UserStore
-func NewUserStore(client *redis.Client) *UserStore {
-	return &UserStore{
+var (
+	_ UserRepository   = (*RedisUserStore)(nil)
+	_ LegacyIDMigrator = (*RedisUserStore)(nil)
+)
+
+// NewRedisUserStore creates a new RedisUserStore
+func NewRedisUserStore(client *redis.Client) *RedisUserStore {
+	return &RedisUserStore{
 		client: client,
 	}
 }
 
-// Create stores a new user in Redis
-func (s *UserStore) Create(ctx context.Context, user *User) error {
+// createUserScript atomically creates a user and its indexes, failing if the
+// username, ID or any identity or UnionID is already taken.
+//
+// KEYS: user:<id>, username:<username>, then the index keys of the identities
+// ARGV: user JSON, user ID
+var createUserScript = redis.NewScript(`
+for i = 3, #KEYS do
+	if redis.call("EXISTS", KEYS[i]) == 1 then
+		return "identity_taken"
+	end
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return "username_taken"
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return "id_taken"
+end
+redis.call("SET", KEYS[1], ARGV[1])
+for i = 2, #KEYS do
+	redis.call("SET", KEYS[i], ARGV[2])
+end
+return "ok"
+`)
+
+// Create stores a new user in Redis together with its indexes in one atomic step.
+// A new ID is generated unless user.ID is already set.
+func (s *RedisUserStore) Create(ctx context.Context, user *User) error {
 	if user.ID == "" {
-		return errors.New("user ID cannot be empty")
+		id, err := NewUserID()
+		if err != nil {
+			return err
+		}
+		user.ID = id
 	}
 
 	// Set creation and update timestamps
 	now := time.Now()
 	user.CreatedAt = now
 	user.UpdatedAt = now
+	user.syncIdentities()
 
 	// Convert user to JSON
 	userJSON, err := json.Marshal(user)
@@ -50,48 +170,68 @@ func (s *UserStore) Create(ctx context.Context, user *User) error {
 		return fmt.Errorf("failed to marshal user: %w", err)
 	}
 
-	// Store user in Redis
-	key := fmt.Sprintf("user:%s", user.ID)
-	if err := s.client.Set(ctx, key, userJSON, 0).Err(); err != nil {
+	keys := append([]string{
+		fmt.Sprintf("user:%s", user.ID),
+		fmt.Sprintf("username:%s", user.Username),
+	}, user.indexKeys()...)
+	result, err := createUserScript.Run(ctx, s.client, keys, userJSON, user.ID).Text()
+	if err != nil {
 		return fmt.Errorf("failed to store user: %w", err)
 	}
 
-	// Add to username index for lookup by username
-	usernameKey := fmt.Sprintf("username:%s", user.Username)
-	if err := s.client.Set(ctx, usernameKey, user.ID, 0).Err(); err != nil {
-		return fmt.Errorf("failed to create username index: %w", err)
+	switch result {
+	case "ok":
+		return nil
+	case "username_taken":
+		return ErrUsernameTaken
+	case "identity_taken":
+		return ErrIdentityTaken
+	case "id_taken":
+		return ErrUserExists
+	default:
+		return fmt.Errorf("unexpected result from create script: %s", result)
 	}
-
-	return nil
 }
 
-// GetByID retrieves a user by ID
-func (s *UserStore) GetByID(ctx context.Context, id string) (*User, error) {
+// GetByID retrieves a user by ID, following the alias of a migrated legacy ID
+func (s *RedisUserStore) GetByID(ctx context.Context, id string) (*User, error) {
 	key := fmt.Sprintf("user:%s", id)
 	userJSON, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		newID, aliasErr := s.client.Get(ctx, fmt.Sprintf("user_alias:%s", id)).Result()
+		if aliasErr == nil {
+			userJSON, err = s.client.Get(ctx, fmt.Sprintf("user:%s", newID)).Result()
+		}
+	}
 	if err != nil {
 		if err == redis.Nil {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
+	return decodeUser(userJSON)
+}
+
+// decodeUser unmarshals a stored user
+func decodeUser(userJSON string) (*User, error) {
 	var user User
 	if err := json.Unmarshal([]byte(userJSON), &user); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal user: %w", err)
 	}
+	user.syncIdentities()
 
 	return &user, nil
 }
 
 // GetByUsername retrieves a user by username
-func (s *UserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+func (s *RedisUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
 	// Get user ID from username index
 	usernameKey := fmt.Sprintf("username:%s", username)
 	id, err := s.client.Get(ctx, usernameKey).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user ID: %w", err)
 	}
@@ -101,13 +241,17 @@ func (s *UserStore) GetByUsername(ctx context.Context, username string) (*User,
 }
 
 // GetByOpenID retrieves a user by WeChat OpenID
-func (s *UserStore) GetByOpenID(ctx context.Context, openID string) (*User, error) {
-	// Get user ID from OpenID index
-	openIDKey := fmt.Sprintf("openid:%s", openID)
-	id, err := s.client.Get(ctx, openIDKey).Result()
+func (s *RedisUserStore) GetByOpenID(ctx context.Context, openID string) (*User, error) {
+	return s.GetByIdentity(ctx, IdentityWeChat, openID)
+}
+
+// GetByIdentity retrieves a user by a linked identity
+func (s *RedisUserStore) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	// Get user ID from identity index
+	id, err := s.client.Get(ctx, identityKey(provider, subject)).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user ID: %w", err)
 	}
@@ -116,117 +260,340 @@ func (s *UserStore) GetByOpenID(ctx context.Context, openID string) (*User, erro
 	return s.GetByID(ctx, id)
 }
 
-// CreateWeChatUser creates a new user with WeChat OpenID
-func (s *UserStore) CreateWeChatUser(ctx context.Context, openID string) (*User, error) {
-	if openID == "" {
-		return nil, errors.New("OpenID cannot be empty")
+// GetByUnionID retrieves a user by WeChat UnionID
+func (s *RedisUserStore) GetByUnionID(ctx context.Context, unionID string) (*User, error) {
+	// Get user ID from UnionID index
+	id, err := s.client.Get(ctx, unionIDKey(unionID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user ID: %w", err)
 	}
 
-	// Check if user with this OpenID already exists
-	openIDKey := fmt.Sprintf("openid:%s", openID)
-	exists, err := s.client.Exists(ctx, openIDKey).Result()
+	// Get user by ID
+	return s.GetByID(ctx, id)
+}
+
+// CreateWeChatUser returns the user with the given UnionID or OpenID, creating it if needed
+func (s *RedisUserStore) CreateWeChatUser(ctx context.Context, openID, unionID string) (*User, error) {
+	return FindOrCreateWeChatUser(ctx, s, IdentityWeChat, openID, unionID)
+}
+
+// Update updates an existing user in an optimistic transaction, so it cannot
+// overwrite identities or roles changed concurrently, and moves the username
+// index along with a new username
+func (s *RedisUserStore) Update(ctx context.Context, user *User) error {
+	// Check if user exists
+	current, err := s.GetByID(ctx, user.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if OpenID exists: %w", err)
+		return err
 	}
-	if exists > 0 {
-		// User already exists, get and return
-		id, err := s.client.Get(ctx, openIDKey).Result()
+	userKey := fmt.Sprintf("user:%s", current.ID)
+	usernameKey := fmt.Sprintf("username:%s", user.Username)
+
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		existing, err := s.getForUpdate(ctx, tx, userKey)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get user ID: %w", err)
+			return err
+		}
+		renamed := existing.Username != user.Username
+		if renamed {
+			owner, err := tx.Get(ctx, usernameKey).Result()
+			if err != nil && err != redis.Nil {
+				return fmt.Errorf("failed to get user ID: %w", err)
+			}
+			if owner != "" && owner != existing.ID {
+				return ErrUsernameTaken
+			}
 		}
-		return s.GetByID(ctx, id)
-	}
 
-	// Generate a unique ID for the user
-	id := fmt.Sprintf("wx_%s", openID)
+		// Identities and their indexes only change through LinkIdentity and
+		// UnlinkIdentity, roles through GrantRole and RevokeRole
+		user.ID = existing.ID
+		user.Identities = existing.Identities
+		user.OpenID = existing.OpenID
+		user.Phone = existing.Phone
+		user.Roles = existing.Roles
 
-	// Create a new user
-	user := &User{
-		ID:        id,
-		Username:  id, // Use ID as username for WeChat users
-		OpenID:    openID,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
+		// Update timestamp
+		user.UpdatedAt = time.Now()
 
-	// Convert user to JSON
-	userJSON, err := json.Marshal(user)
+		// Convert user to JSON
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user: %w", err)
+		}
+
+		// Store updated user and its username index in Redis
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, userKey, userJSON, 0)
+			if renamed {
+				pipe.Del(ctx, fmt.Sprintf("username:%s", existing.Username))
+				pipe.Set(ctx, usernameKey, user.ID, 0)
+			}
+			return nil
+		})
+		return err
+	}, userKey, usernameKey)
+}
+
+// maxWatchRetries bounds how often an optimistic transaction is retried
+const maxWatchRetries = 10
+
+// LinkIdentity attaches an identity to a user
+func (s *RedisUserStore) LinkIdentity(ctx context.Context, userID string, identity Identity) (*User, error) {
+	current, err := s.GetByID(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal user: %w", err)
+		return nil, err
 	}
+	userKey := fmt.Sprintf("user:%s", current.ID)
+	indexKeys := identity.indexKeys()
+
+	var user *User
+	err = s.watch(ctx, func(tx *redis.Tx) error {
+		for _, key := range indexKeys {
+			owner, err := tx.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return fmt.Errorf("failed to get user ID: %w", err)
+			}
+			if owner != "" && owner != current.ID {
+				return ErrIdentityTaken
+			}
+		}
+
+		user, err = s.getForUpdate(ctx, tx, userKey)
+		if err != nil {
+			return err
+		}
+		if err := user.addIdentity(identity); err != nil {
+			return err
+		}
+		user.UpdatedAt = time.Now()
 
-	// Store user in Redis
-	key := fmt.Sprintf("user:%s", user.ID)
-	if err := s.client.Set(ctx, key, userJSON, 0).Err(); err != nil {
-		return nil, fmt.Errorf("failed to store user: %w", err)
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user: %w", err)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, userKey, userJSON, 0)
+			for _, key := range indexKeys {
+				pipe.Set(ctx, key, user.ID, 0)
+			}
+			return nil
+		})
+		return err
+	}, append([]string{userKey}, indexKeys...)...)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add to username index for lookup by username
-	usernameKey := fmt.Sprintf("username:%s", user.Username)
-	if err := s.client.Set(ctx, usernameKey, user.ID, 0).Err(); err != nil {
-		return nil, fmt.Errorf("failed to create username index: %w", err)
+	return user, nil
+}
+
+// UnlinkIdentity removes the user's identity from provider
+func (s *RedisUserStore) UnlinkIdentity(ctx context.Context, userID, provider string) (*User, error) {
+	current, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
 	}
+	userKey := fmt.Sprintf("user:%s", current.ID)
 
-	// Add to OpenID index for lookup by OpenID
-	if err := s.client.Set(ctx, openIDKey, user.ID, 0).Err(); err != nil {
-		return nil, fmt.Errorf("failed to create OpenID index: %w", err)
+	var user *User
+	err = s.watch(ctx, func(tx *redis.Tx) error {
+		user, err = s.getForUpdate(ctx, tx, userKey)
+		if err != nil {
+			return err
+		}
+		identity, err := user.removeIdentity(provider)
+		if err != nil {
+			return err
+		}
+		user.UpdatedAt = time.Now()
+
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user: %w", err)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, userKey, userJSON, 0)
+			pipe.Del(ctx, identityKey(identity.Provider, identity.Subject))
+			if identity.UnionID != "" && !user.hasUnionID(identity.UnionID) {
+				pipe.Del(ctx, unionIDKey(identity.UnionID))
+			}
+			return nil
+		})
+		return err
+	}, userKey)
+	if err != nil {
+		return nil, err
 	}
 
 	return user, nil
 }
 
-// Update updates an existing user
-func (s *UserStore) Update(ctx context.Context, user *User) error {
-	// Check if user exists
-	_, err := s.GetByID(ctx, user.ID)
+// GrantRole gives a user a role
+func (s *RedisUserStore) GrantRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(ctx, userID, func(user *User) bool { return user.addRole(role) })
+}
+
+// RevokeRole takes a role from a user
+func (s *RedisUserStore) RevokeRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(ctx, userID, func(user *User) bool { return user.removeRole(role) })
+}
+
+// updateRoles applies change to the user's roles in an optimistic
+// transaction, storing the user if change reports a difference
+func (s *RedisUserStore) updateRoles(ctx context.Context, userID string, change func(user *User) bool) (*User, error) {
+	current, err := s.GetByID(ctx, userID)
 	if err != nil {
+		return nil, err
+	}
+	userKey := fmt.Sprintf("user:%s", current.ID)
+
+	var user *User
+	err = s.watch(ctx, func(tx *redis.Tx) error {
+		user, err = s.getForUpdate(ctx, tx, userKey)
+		if err != nil {
+			return err
+		}
+		if !change(user) {
+			return nil
+		}
+		user.UpdatedAt = time.Now()
+
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user: %w", err)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, userKey, userJSON, 0)
+			return nil
+		})
 		return err
+	}, userKey)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update timestamp
-	user.UpdatedAt = time.Now()
+	return user, nil
+}
 
-	// Convert user to JSON
-	userJSON, err := json.Marshal(user)
+// watch runs fn in an optimistic transaction over keys, retrying when they
+// are modified concurrently
+func (s *RedisUserStore) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxWatchRetries; i++ {
+		err := s.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.New("failed to update user: too many concurrent updates")
+}
+
+// getForUpdate reads a watched user inside an optimistic transaction
+func (s *RedisUserStore) getForUpdate(ctx context.Context, tx *redis.Tx, userKey string) (*User, error) {
+	userJSON, err := tx.Get(ctx, userKey).Result()
 	if err != nil {
-		return fmt.Errorf("failed to marshal user: %w", err)
+		if err == redis.Nil {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	return decodeUser(userJSON)
+}
+
+// migrateUserScript moves a user to a new ID, repoints its indexes and leaves
+// an alias behind. It does nothing if the old user is gone.
+//
+// KEYS: user:<old>, user:<new>, user_alias:<old>, username:<username>, then the index keys of the identities
+// ARGV: user JSON with the new ID, new ID
+var migrateUserScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[1])
+for i = 3, #KEYS do
+	redis.call("SET", KEYS[i], ARGV[2])
+end
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+// MigrateLegacyIDs gives every user with a legacy ID a generated one
+func (s *RedisUserStore) MigrateLegacyIDs(ctx context.Context) (map[string]string, error) {
+	migrated := make(map[string]string)
+
+	iter := s.client.Scan(ctx, 0, "user:*", 100).Iterator()
+	for iter.Next(ctx) {
+		oldID := strings.TrimPrefix(iter.Val(), "user:")
+		if !isLegacyID(oldID) {
+			continue
+		}
+
+		user, err := s.GetByID(ctx, oldID)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				continue
+			}
+			return migrated, err
+		}
+
+		newID, err := NewUserID()
+		if err != nil {
+			return migrated, err
+		}
+		user.ID = newID
+
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to marshal user: %w", err)
+		}
 
-	// Store updated user in Redis
-	key := fmt.Sprintf("user:%s", user.ID)
-	if err := s.client.Set(ctx, key, userJSON, 0).Err(); err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
+		keys := []string{
+			fmt.Sprintf("user:%s", oldID),
+			fmt.Sprintf("user:%s", newID),
+			fmt.Sprintf("user_alias:%s", oldID),
+			fmt.Sprintf("username:%s", user.Username),
+		}
+		keys = append(keys, user.indexKeys()...)
+		moved, err := migrateUserScript.Run(ctx, s.client, keys, userJSON, newID).Int()
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate user %s: %w", oldID, err)
+		}
+		if moved == 1 {
+			migrated[oldID] = newID
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return migrated, fmt.Errorf("failed to scan users: %w", err)
 	}
 
-	return nil
+	return migrated, nil
 }
 
-// Delete removes a user
-func (s *UserStore) Delete(ctx context.Context, id string) error {
+// Delete removes a user. A migrated legacy ID deletes the user it points to.
+func (s *RedisUserStore) Delete(ctx context.Context, id string) error {
 	// Get user to check if exists and to get username
 	user, err := s.GetByID(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	// Delete user
-	key := fmt.Sprintf("user:%s", id)
-	if err := s.client.Del(ctx, key).Err(); err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
-	}
-
-	// Delete username index
-	usernameKey := fmt.Sprintf("username:%s", user.Username)
-	if err := s.client.Del(ctx, usernameKey).Err(); err != nil {
-		return fmt.Errorf("failed to delete username index: %w", err)
-	}
-
-	// Delete OpenID index if exists
-	if user.OpenID != "" {
-		openIDKey := fmt.Sprintf("openid:%s", user.OpenID)
-		if err := s.client.Del(ctx, openIDKey).Err(); err != nil {
-			return fmt.Errorf("failed to delete OpenID index: %w", err)
+	// Delete user and its indexes together
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, fmt.Sprintf("user:%s", user.ID))
+		if id != user.ID {
+			pipe.Del(ctx, fmt.Sprintf("user_alias:%s", id))
+		}
+		pipe.Del(ctx, fmt.Sprintf("username:%s", user.Username))
+		for _, key := range user.indexKeys() {
+			pipe.Del(ctx, key)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is a UserRepository that keeps users in process memory.
+// It is meant for tests and local development; all data is lost on restart.
+type MemoryUserStore struct {
+	mu         sync.RWMutex
+	users      map[string]*User
+	byUsername map[string]string
+	byIdentity map[string]string
+}
+
+var _ UserRepository = (*MemoryUserStore)(nil)
+
+// NewMemoryUserStore creates a new MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:      make(map[string]*User),
+		byUsername: make(map[string]string),
+		byIdentity: make(map[string]string),
+	}
+}
+
+// Create stores a new user, generating its ID unless user.ID is already set
+func (s *MemoryUserStore) Create(ctx context.Context, user *User) error {
+	if user.ID == "" {
+		id, err := NewUserID()
+		if err != nil {
+			return err
+		}
+		user.ID = id
+	}
+
+	// Set creation and update timestamps
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	user.syncIdentities()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkConflicts(user); err != nil {
+		return err
+	}
+
+	s.put(user)
+	return nil
+}
+
+// GetByID retrieves a user by ID
+func (s *MemoryUserStore) GetByID(ctx context.Context, id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(id)
+}
+
+// GetByUsername retrieves a user by username
+func (s *MemoryUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byUsername[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.get(id)
+}
+
+// GetByOpenID retrieves a user by WeChat OpenID
+func (s *MemoryUserStore) GetByOpenID(ctx context.Context, openID string) (*User, error) {
+	return s.GetByIdentity(ctx, IdentityWeChat, openID)
+}
+
+// GetByIdentity retrieves a user by a linked identity
+func (s *MemoryUserStore) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byIdentity[identityKey(provider, subject)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.get(id)
+}
+
+// GetByUnionID retrieves a user by WeChat UnionID
+func (s *MemoryUserStore) GetByUnionID(ctx context.Context, unionID string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byIdentity[unionIDKey(unionID)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.get(id)
+}
+
+// CreateWeChatUser returns the user with the given UnionID or OpenID, creating it if needed
+func (s *MemoryUserStore) CreateWeChatUser(ctx context.Context, openID, unionID string) (*User, error) {
+	return FindOrCreateWeChatUser(ctx, s, IdentityWeChat, openID, unionID)
+}
+
+// Update updates an existing user
+func (s *MemoryUserStore) Update(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[user.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if owner, ok := s.byUsername[user.Username]; ok && owner != user.ID {
+		return ErrUsernameTaken
+	}
+
+	// Identities only change through LinkIdentity and UnlinkIdentity, roles
+	// through GrantRole and RevokeRole
+	user.Identities = existing.Identities
+	user.OpenID = existing.OpenID
+	user.Phone = existing.Phone
+	user.Roles = existing.Roles
+
+	user.UpdatedAt = time.Now()
+	s.remove(user.ID)
+	s.put(user)
+	return nil
+}
+
+// LinkIdentity attaches an identity to a user
+func (s *MemoryUserStore) LinkIdentity(ctx context.Context, userID string, identity Identity) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.get(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range identity.indexKeys() {
+		if owner, ok := s.byIdentity[key]; ok && owner != user.ID {
+			return nil, ErrIdentityTaken
+		}
+	}
+	if err := user.addIdentity(identity); err != nil {
+		return nil, err
+	}
+
+	user.UpdatedAt = time.Now()
+	s.remove(userID)
+	s.put(user)
+	return s.get(userID)
+}
+
+// UnlinkIdentity removes the user's identity from provider
+func (s *MemoryUserStore) UnlinkIdentity(ctx context.Context, userID, provider string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.get(userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := user.removeIdentity(provider); err != nil {
+		return nil, err
+	}
+
+	user.UpdatedAt = time.Now()
+	s.remove(userID)
+	s.put(user)
+	return s.get(userID)
+}
+
+// GrantRole gives a user a role
+func (s *MemoryUserStore) GrantRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(userID, func(user *User) bool { return user.addRole(role) })
+}
+
+// RevokeRole takes a role from a user
+func (s *MemoryUserStore) RevokeRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(userID, func(user *User) bool { return user.removeRole(role) })
+}
+
+// updateRoles applies change to the user's roles, storing the user if change
+// reports a difference
+func (s *MemoryUserStore) updateRoles(userID string, change func(user *User) bool) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.get(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !change(user) {
+		return user, nil
+	}
+
+	user.UpdatedAt = time.Now()
+	s.remove(userID)
+	s.put(user)
+	return s.get(userID)
+}
+
+// Delete removes a user
+func (s *MemoryUserStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+
+	s.remove(id)
+	return nil
+}
+
+// checkConflicts reports whether a new user collides with an existing one.
+// The caller must hold the lock.
+func (s *MemoryUserStore) checkConflicts(user *User) error {
+	for _, key := range user.indexKeys() {
+		if _, ok := s.byIdentity[key]; ok {
+			return ErrIdentityTaken
+		}
+	}
+	if _, ok := s.byUsername[user.Username]; ok {
+		return ErrUsernameTaken
+	}
+	if _, ok := s.users[user.ID]; ok {
+		return ErrUserExists
+	}
+	return nil
+}
+
+// get returns a copy of the user so callers cannot modify the stored value.
+// The caller must hold the lock.
+func (s *MemoryUserStore) get(id string) (*User, error) {
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// put stores a copy of the user and indexes it. The caller must hold the lock.
+func (s *MemoryUserStore) put(user *User) {
+	u := copyUser(user)
+	s.users[u.ID] = u
+	s.byUsername[u.Username] = u.ID
+	for _, key := range u.indexKeys() {
+		s.byIdentity[key] = u.ID
+	}
+}
+
+// copyUser copies a user including its identities and roles
+func copyUser(user *User) *User {
+	u := *user
+	u.Identities = append([]Identity(nil), user.Identities...)
+	u.Roles = append([]string(nil), user.Roles...)
+	return &u
+}
+
+// remove deletes a user and its indexes. The caller must hold the lock.
+func (s *MemoryUserStore) remove(id string) {
+	user, ok := s.users[id]
+	if !ok {
+		return
+	}
+	delete(s.users, id)
+	delete(s.byUsername, user.Username)
+	for _, key := range user.indexKeys() {
+		delete(s.byIdentity, key)
+	}
+}
@@ -0,0 +1,714 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// userMigrations are applied in order and recorded in schema_migrations.
+// The SQL must work on both SQLite and PostgreSQL. Never edit an applied
+// migration; append a new one instead.
+var userMigrations = []string{
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL UNIQUE,
+		password   TEXT NOT NULL DEFAULT '',
+		email      TEXT UNIQUE,
+		open_id    TEXT UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE user_aliases (
+		old_id  TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE user_identities (
+		provider  TEXT NOT NULL,
+		subject   TEXT NOT NULL,
+		user_id   TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+		linked_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (provider, subject),
+		UNIQUE (user_id, provider)
+	)`,
+	`INSERT INTO user_identities (provider, subject, user_id, linked_at)
+	 SELECT 'wechat', open_id, id, created_at FROM users WHERE open_id IS NOT NULL`,
+	`ALTER TABLE user_identities ADD COLUMN union_id TEXT`,
+	`CREATE TABLE user_union_ids (
+		union_id TEXT PRIMARY KEY,
+		user_id  TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`ALTER TABLE users ADD COLUMN nickname TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN phone TEXT`,
+	`CREATE UNIQUE INDEX users_phone_key ON users (phone)`,
+	`CREATE TABLE user_roles (
+		user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+		role       TEXT NOT NULL,
+		granted_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, role)
+	)`,
+	`ALTER TABLE users ADD COLUMN banned BOOLEAN NOT NULL DEFAULT FALSE`,
+}
+
+// SQLUserStore is a UserRepository backed by a SQL database (SQLite or PostgreSQL).
+// Queries use $N placeholders, which both databases accept. SQLite numbers
+// them by first appearance, so they must appear in ascending order.
+//
+// Identities live in user_identities; users.open_id and users.phone mirror the
+// WeChat and phone identities and user_union_ids maps each UnionID to its one user.
+// Roles live in user_roles.
+// SQLite does not enforce foreign keys by default, so dependent rows are
+// updated and deleted explicitly rather than through ON UPDATE/DELETE CASCADE.
+type SQLUserStore struct {
+	db *sql.DB
+}
+
+var (
+	_ UserRepository   = (*SQLUserStore)(nil)
+	_ LegacyIDMigrator = (*SQLUserStore)(nil)
+)
+
+// NewSQLUserStore creates a new SQLUserStore. Call Migrate before using it.
+func NewSQLUserStore(db *sql.DB) *SQLUserStore {
+	return &SQLUserStore{
+		db: db,
+	}
+}
+
+// Migrate brings the database schema up to date
+func (s *SQLUserStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(userMigrations); i++ {
+		version := i + 1
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, userMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// Create stores a new user, generating its ID unless user.ID is already set
+func (s *SQLUserStore) Create(ctx context.Context, user *User) error {
+	if user.ID == "" {
+		id, err := NewUserID()
+		if err != nil {
+			return err
+		}
+		user.ID = id
+	}
+
+	// Set creation and update timestamps
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	user.syncIdentities()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO users (id, username, password, email, open_id, phone, nickname, avatar_url, banned, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		user.ID, user.Username, user.Password, nullString(user.Email), nullString(user.OpenID), nullString(user.Phone),
+		user.Nickname, user.AvatarURL, user.Banned, user.CreatedAt, user.UpdatedAt,
+	)
+	if err != nil {
+		if taken := uniqueViolation(err); taken != nil {
+			return taken
+		}
+		return fmt.Errorf("failed to store user: %w", err)
+	}
+	for _, identity := range user.Identities {
+		if err := insertIdentity(ctx, tx, user.ID, identity); err != nil {
+			return err
+		}
+	}
+	for _, role := range user.Roles {
+		if _, err := insertRole(ctx, tx, user.ID, role); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store user: %w", err)
+	}
+	return nil
+}
+
+// GetByID retrieves a user by ID, following the alias of a migrated legacy ID
+func (s *SQLUserStore) GetByID(ctx context.Context, id string) (*User, error) {
+	user, err := s.getBy(ctx, "id", id)
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+
+	var newID string
+	err = s.db.QueryRowContext(ctx, `SELECT user_id FROM user_aliases WHERE old_id = $1`, id).Scan(&newID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user alias: %w", err)
+	}
+	return s.getBy(ctx, "id", newID)
+}
+
+// GetByUsername retrieves a user by username
+func (s *SQLUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return s.getBy(ctx, "username", username)
+}
+
+// GetByOpenID retrieves a user by WeChat OpenID
+func (s *SQLUserStore) GetByOpenID(ctx context.Context, openID string) (*User, error) {
+	return s.getBy(ctx, "open_id", openID)
+}
+
+// GetByIdentity retrieves a user by a linked identity
+func (s *SQLUserStore) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		provider, subject,
+	).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user ID: %w", err)
+	}
+	return s.getBy(ctx, "id", id)
+}
+
+// GetByUnionID retrieves a user by WeChat UnionID
+func (s *SQLUserStore) GetByUnionID(ctx context.Context, unionID string) (*User, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM user_union_ids WHERE union_id = $1`, unionID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user ID: %w", err)
+	}
+	return s.getBy(ctx, "id", id)
+}
+
+// CreateWeChatUser returns the user with the given UnionID or OpenID, creating it if needed
+func (s *SQLUserStore) CreateWeChatUser(ctx context.Context, openID, unionID string) (*User, error) {
+	return FindOrCreateWeChatUser(ctx, s, IdentityWeChat, openID, unionID)
+}
+
+// Update updates an existing user
+func (s *SQLUserStore) Update(ctx context.Context, user *User) error {
+	// Update timestamp
+	user.UpdatedAt = time.Now().UTC()
+
+	// Identities, open_id and phone only change through LinkIdentity and
+	// UnlinkIdentity, roles through GrantRole and RevokeRole
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE users SET username = $1, password = $2, email = $3, nickname = $4, avatar_url = $5, banned = $6, updated_at = $7
+		 WHERE id = $8`,
+		user.Username, user.Password, nullString(user.Email), user.Nickname, user.AvatarURL, user.Banned, user.UpdatedAt, user.ID,
+	)
+	if err != nil {
+		if taken := uniqueViolation(err); taken != nil {
+			return taken
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+
+	return checkAffected(res)
+}
+
+// LinkIdentity attaches an identity to a user
+func (s *SQLUserStore) LinkIdentity(ctx context.Context, userID string, identity Identity) (*User, error) {
+	user, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var owner string
+	err = tx.QueryRowContext(ctx,
+		`SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		identity.Provider, identity.Subject,
+	).Scan(&owner)
+	switch {
+	case err == nil && owner == user.ID:
+		// Already linked, record the UnionID if it is new
+		existing := user.Identity(identity.Provider)
+		if identity.UnionID == "" || existing.UnionID != "" {
+			return user, nil
+		}
+		existing.UnionID = identity.UnionID
+		_, err = tx.ExecContext(ctx,
+			`UPDATE user_identities SET union_id = $1 WHERE provider = $2 AND subject = $3`,
+			identity.UnionID, identity.Provider, identity.Subject,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to link identity: %w", err)
+		}
+		if err := linkUnionID(ctx, tx, user.ID, identity.UnionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to link identity: %w", err)
+		}
+		return user, nil
+	case err == nil:
+		return nil, ErrIdentityTaken
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	if err := user.addIdentity(identity); err != nil {
+		return nil, err
+	}
+	if err := insertIdentity(ctx, tx, user.ID, *user.Identity(identity.Provider)); err != nil {
+		return nil, err
+	}
+	if err := s.touch(ctx, tx, user); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+	return user, nil
+}
+
+// UnlinkIdentity removes the user's identity from provider
+func (s *SQLUserStore) UnlinkIdentity(ctx context.Context, userID, provider string) (*User, error) {
+	user, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := user.removeIdentity(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the user row first so concurrent unlinks cannot both pass the
+	// last login method check below
+	if err := s.touch(ctx, tx, user); err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM user_identities WHERE user_id = $1 AND provider = $2
+		 AND (EXISTS (SELECT 1 FROM users WHERE id = $1 AND password <> '')
+		      OR (SELECT COUNT(*) FROM user_identities WHERE user_id = $1) > 1)`,
+		user.ID, provider,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlink identity: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check affected rows: %w", err)
+	}
+	if n == 0 {
+		// The user changed since it was read: find out whether the identity is
+		// already gone or is now the last login method. Release the connection
+		// first, SQLite runs with a single one.
+		tx.Rollback()
+		current, err := s.GetByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = current.removeIdentity(provider)
+		if err == nil {
+			err = ErrLastLoginMethod
+		}
+		return nil, err
+	}
+
+	if identity.UnionID != "" {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM user_union_ids WHERE union_id = $1
+			 AND NOT EXISTS (SELECT 1 FROM user_identities WHERE union_id = $1)`,
+			identity.UnionID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unlink UnionID: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to unlink identity: %w", err)
+	}
+	return user, nil
+}
+
+// GrantRole gives a user a role
+func (s *SQLUserStore) GrantRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(ctx, userID, func(tx *sql.Tx, id string) (bool, error) {
+		return insertRole(ctx, tx, id, role)
+	})
+}
+
+// RevokeRole takes a role from a user
+func (s *SQLUserStore) RevokeRole(ctx context.Context, userID, role string) (*User, error) {
+	return s.updateRoles(ctx, userID, func(tx *sql.Tx, id string) (bool, error) {
+		res, err := tx.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = $1 AND role = $2`, id, role)
+		if err != nil {
+			return false, fmt.Errorf("failed to revoke role: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("failed to check affected rows: %w", err)
+		}
+		return n > 0, nil
+	})
+}
+
+// updateRoles runs change on the user's roles inside a transaction, bumping
+// the user's updated_at if change reports a difference
+func (s *SQLUserStore) updateRoles(ctx context.Context, userID string, change func(tx *sql.Tx, id string) (bool, error)) (*User, error) {
+	user, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	changed, err := change(tx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return user, nil
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE users SET updated_at = $1 WHERE id = $2`, time.Now().UTC(), user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	if err := checkAffected(res); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update roles: %w", err)
+	}
+	return s.getBy(ctx, "id", user.ID)
+}
+
+// touch bumps the user's updated_at and syncs open_id and phone with their
+// identities inside tx, which also locks the row on PostgreSQL
+func (s *SQLUserStore) touch(ctx context.Context, tx *sql.Tx, user *User) error {
+	user.UpdatedAt = time.Now().UTC()
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET open_id = $1, phone = $2, updated_at = $3 WHERE id = $4`,
+		nullString(user.OpenID), nullString(user.Phone), user.UpdatedAt, user.ID,
+	)
+	if err != nil {
+		if taken := uniqueViolation(err); taken != nil {
+			return taken
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return checkAffected(res)
+}
+
+// MigrateLegacyIDs gives every user with a legacy ID a generated one
+func (s *SQLUserStore) MigrateLegacyIDs(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM users`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	var legacy []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan user ID: %w", err)
+		}
+		if isLegacyID(id) {
+			legacy = append(legacy, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	migrated := make(map[string]string)
+	for _, oldID := range legacy {
+		newID, err := NewUserID()
+		if err != nil {
+			return migrated, err
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET id = $1 WHERE id = $2`, newID, oldID); err != nil {
+			tx.Rollback()
+			return migrated, fmt.Errorf("failed to migrate user %s: %w", oldID, err)
+		}
+		// A no-op on PostgreSQL, where ON UPDATE CASCADE already moved them
+		for _, table := range []string{"user_identities", "user_union_ids", "user_roles"} {
+			if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET user_id = $1 WHERE user_id = $2`, newID, oldID); err != nil {
+				tx.Rollback()
+				return migrated, fmt.Errorf("failed to migrate identities of user %s: %w", oldID, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_aliases (old_id, user_id) VALUES ($1, $2)`, oldID, newID); err != nil {
+			tx.Rollback()
+			return migrated, fmt.Errorf("failed to record alias for user %s: %w", oldID, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return migrated, fmt.Errorf("failed to migrate user %s: %w", oldID, err)
+		}
+		migrated[oldID] = newID
+	}
+
+	return migrated, nil
+}
+
+// Delete removes a user together with its identities, roles and aliases. A
+// migrated legacy ID deletes the user it points to.
+func (s *SQLUserStore) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var newID string
+	err = tx.QueryRowContext(ctx, `SELECT user_id FROM user_aliases WHERE old_id = $1`, id).Scan(&newID)
+	switch {
+	case err == nil:
+		id = newID
+	case !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("failed to get user alias: %w", err)
+	}
+
+	for _, table := range []string{"user_identities", "user_union_ids", "user_roles", "user_aliases"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, id); err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if err := checkAffected(res); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// getBy retrieves a user by a unique column. column is never user input.
+func (s *SQLUserStore) getBy(ctx context.Context, column, value string) (*User, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, username, password, email, open_id, phone, nickname, avatar_url, banned, created_at, updated_at
+		 FROM users WHERE `+column+` = $1`,
+		value,
+	)
+
+	var user User
+	var email, openID, phone sql.NullString
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &email, &openID, &phone, &user.Nickname, &user.AvatarURL, &user.Banned, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	user.Email = email.String
+	user.OpenID = openID.String
+	user.Phone = phone.String
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT provider, subject, linked_at, union_id FROM user_identities WHERE user_id = $1 ORDER BY linked_at`,
+		user.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity Identity
+		var unionID sql.NullString
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.LinkedAt, &unionID); err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %w", err)
+		}
+		identity.UnionID = unionID.String
+		user.Identities = append(user.Identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get identities: %w", err)
+	}
+	user.syncIdentities()
+
+	roleRows, err := s.db.QueryContext(ctx, `SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles: %w", err)
+	}
+	defer roleRows.Close()
+	for roleRows.Next() {
+		var role string
+		if err := roleRows.Scan(&role); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		user.Roles = append(user.Roles, role)
+	}
+	if err := roleRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get roles: %w", err)
+	}
+
+	return &user, nil
+}
+
+// insertIdentity links an identity and its UnionID to a user inside tx
+func insertIdentity(ctx context.Context, tx *sql.Tx, userID string, identity Identity) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO user_identities (provider, subject, user_id, linked_at, union_id) VALUES ($1, $2, $3, $4, $5)`,
+		identity.Provider, identity.Subject, userID, identity.LinkedAt.UTC(), nullString(identity.UnionID),
+	)
+	if err != nil {
+		if taken := uniqueViolation(err); taken != nil {
+			return taken
+		}
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	if identity.UnionID == "" {
+		return nil
+	}
+	return linkUnionID(ctx, tx, userID, identity.UnionID)
+}
+
+// insertRole gives a user a role inside tx, reporting whether it is new
+func insertRole(ctx context.Context, tx *sql.Tx, userID, role string) (bool, error) {
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO user_roles (user_id, role, granted_at) VALUES ($1, $2, $3) ON CONFLICT (user_id, role) DO NOTHING`,
+		userID, role, time.Now().UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to grant role: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to check affected rows: %w", err)
+	}
+	return n > 0, nil
+}
+
+// linkUnionID maps a UnionID to a user inside tx, returning ErrIdentityTaken
+// if it already belongs to another user
+func linkUnionID(ctx context.Context, tx *sql.Tx, userID, unionID string) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO user_union_ids (union_id, user_id) VALUES ($1, $2) ON CONFLICT (union_id) DO NOTHING`,
+		unionID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to link UnionID: %w", err)
+	}
+
+	var owner string
+	err = tx.QueryRowContext(ctx, `SELECT user_id FROM user_union_ids WHERE union_id = $1`, unionID).Scan(&owner)
+	if err != nil {
+		return fmt.Errorf("failed to get UnionID: %w", err)
+	}
+	if owner != userID {
+		return ErrIdentityTaken
+	}
+	return nil
+}
+
+// uniqueViolation maps a unique constraint error to the matching typed error,
+// or returns nil for any other error. It matches on the message so models does
+// not depend on the drivers: PostgreSQL reports the constraint name
+// ("users_username_key") and SQLite the column ("users.username").
+func uniqueViolation(err error) error {
+	msg := err.Error()
+	if !strings.Contains(msg, "duplicate key value") && !strings.Contains(msg, "UNIQUE constraint failed") {
+		return nil
+	}
+
+	switch {
+	case strings.Contains(msg, "user_identities_user_id"), strings.Contains(msg, "user_identities.user_id"):
+		return ErrProviderLinked
+	case strings.Contains(msg, "user_identities"):
+		return ErrIdentityTaken
+	case strings.Contains(msg, "username"):
+		return ErrUsernameTaken
+	case strings.Contains(msg, "open_id"), strings.Contains(msg, "phone"):
+		return ErrIdentityTaken
+	case strings.Contains(msg, "email"):
+		return ErrEmailTaken
+	default:
+		return ErrUserExists
+	}
+}
+
+// nullString stores empty strings as NULL so unique columns allow many empty values
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check affected rows: %w", err)
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
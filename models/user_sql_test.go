@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB returns an empty SQLite database for the test
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestSQLStore returns a migrated SQLite user store for the test
+func newTestSQLStore(t *testing.T) *SQLUserStore {
+	t.Helper()
+	store := NewSQLUserStore(newTestDB(t))
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLUserStoreMigrate(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLStore(t)
+
+	// Migrating an up to date database changes nothing
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+	var version, applied int
+	if err := store.db.QueryRowContext(ctx, `SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(userMigrations) || applied != len(userMigrations) {
+		t.Errorf("schema version %d with %d migrations applied, want %d", version, applied, len(userMigrations))
+	}
+}
+
+func TestSQLUserStoreMigrateExistingUsers(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// A database created by the first version of the schema
+	if _, err := db.ExecContext(ctx, `CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, userMigrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (1, $1)`, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO users (id, username, password, email, open_id, created_at, updated_at) VALUES ('wx_openid-alice', 'alice', '', NULL, 'openid-alice', $1, $2)`,
+		time.Now().UTC(), time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewSQLUserStore(db)
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The OpenID column became a WeChat identity
+	user, err := store.GetByIdentity(ctx, IdentityWeChat, "openid-alice")
+	if err != nil {
+		t.Fatalf("GetByIdentity after migrating: %v", err)
+	}
+	if user.ID != "wx_openid-alice" || user.OpenID != "openid-alice" || len(user.Identities) != 1 {
+		t.Errorf("user after migrating = %+v", user)
+	}
+}
+
+func TestSQLUserStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLStore(t)
+
+	alice := &User{Username: "alice", Password: "hash", Email: "alice@example.com", OpenID: "openid-alice"}
+	if err := store.Create(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if isLegacyID(alice.ID) {
+		t.Errorf("Create gave the user ID %q, want a generated one", alice.ID)
+	}
+	// Users without an email or OpenID do not collide on them
+	for _, username := range []string{"bob", "carol"} {
+		if err := store.Create(ctx, &User{Username: username}); err != nil {
+			t.Fatalf("Create %s: %v", username, err)
+		}
+	}
+
+	conflicts := []struct {
+		name string
+		user *User
+		want error
+	}{
+		{"username", &User{Username: "alice"}, ErrUsernameTaken},
+		{"email", &User{Username: "dave", Email: "alice@example.com"}, ErrEmailTaken},
+		{"OpenID", &User{Username: "dave", OpenID: "openid-alice"}, ErrIdentityTaken},
+		{"ID", &User{ID: alice.ID, Username: "dave"}, ErrUserExists},
+	}
+	for _, tt := range conflicts {
+		if err := store.Create(ctx, tt.user); !errors.Is(err, tt.want) {
+			t.Errorf("Create with a taken %s = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	for name, get := range map[string]func() (*User, error){
+		"ID":       func() (*User, error) { return store.GetByID(ctx, alice.ID) },
+		"username": func() (*User, error) { return store.GetByUsername(ctx, "alice") },
+		"OpenID":   func() (*User, error) { return store.GetByOpenID(ctx, "openid-alice") },
+	} {
+		user, err := get()
+		if err != nil || user.ID != alice.ID || user.Email != "alice@example.com" || user.Password != "hash" {
+			t.Errorf("by %s = %+v, %v", name, user, err)
+		}
+	}
+	if _, err := store.GetByUsername(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetByUsername of an unknown user = %v, want ErrUserNotFound", err)
+	}
+
+	alice.Email = "alice@example.org"
+	alice.Banned = true
+	if err := store.Update(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := store.GetByID(ctx, alice.ID); err != nil || user.Email != "alice@example.org" || !user.Banned {
+		t.Errorf("user after Update = %+v, %v", user, err)
+	}
+	if err := store.Update(ctx, &User{ID: "unknown", Username: "dave"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Update of an unknown user = %v, want ErrUserNotFound", err)
+	}
+
+	if err := store.Delete(ctx, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetByOpenID(ctx, "openid-alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetByOpenID after Delete = %v, want ErrUserNotFound", err)
+	}
+	if err := store.Delete(ctx, alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("second Delete = %v, want ErrUserNotFound", err)
+	}
+}
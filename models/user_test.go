@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// legacyUserStore is a user store that can hold legacy IDs
+type legacyUserStore interface {
+	UserRepository
+	LegacyIDMigrator
+}
+
+// forEachLegacyStore runs fn against every store that migrates legacy IDs
+func forEachLegacyStore(t *testing.T, fn func(t *testing.T, store legacyUserStore)) {
+	t.Run("redis", func(t *testing.T) { fn(t, NewRedisUserStore(newTestRedis(t))) })
+	t.Run("sql", func(t *testing.T) { fn(t, newTestSQLStore(t)) })
+}
+
+// createLegacyUser stores a user the way it was stored before IDs were generated
+func createLegacyUser(t *testing.T, store legacyUserStore) {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.Create(ctx, &User{ID: "alice", Username: "alice", Email: "alice@example.com", OpenID: "openid-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GrantRole(ctx, "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyIDs(t *testing.T) {
+	forEachLegacyStore(t, func(t *testing.T, store legacyUserStore) {
+		ctx := context.Background()
+		createLegacyUser(t, store)
+		modern := &User{Username: "bob", Email: "bob@example.com"}
+		if err := store.Create(ctx, modern); err != nil {
+			t.Fatal(err)
+		}
+
+		migrated, err := store.MigrateLegacyIDs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newID, ok := migrated["alice"]
+		if len(migrated) != 1 || !ok || isLegacyID(newID) {
+			t.Fatalf("MigrateLegacyIDs = %v, want only alice moved to a generated ID", migrated)
+		}
+
+		for name, get := range map[string]func() (*User, error){
+			"old ID":   func() (*User, error) { return store.GetByID(ctx, "alice") },
+			"new ID":   func() (*User, error) { return store.GetByID(ctx, newID) },
+			"username": func() (*User, error) { return store.GetByUsername(ctx, "alice") },
+			"OpenID":   func() (*User, error) { return store.GetByOpenID(ctx, "openid-alice") },
+		} {
+			user, err := get()
+			if err != nil {
+				t.Errorf("by %s: %v", name, err)
+				continue
+			}
+			if user.ID != newID || !slices.Contains(user.Roles, "admin") {
+				t.Errorf("by %s: ID %q, roles %v, want %q with admin", name, user.ID, user.Roles, newID)
+			}
+		}
+		if user, err := store.GetByID(ctx, modern.ID); err != nil || user.Username != "bob" {
+			t.Errorf("modern user after migration = %v, %v", user, err)
+		}
+
+		migrated, err = store.MigrateLegacyIDs(ctx)
+		if err != nil || len(migrated) != 0 {
+			t.Errorf("second MigrateLegacyIDs = %v, %v, want nothing to do", migrated, err)
+		}
+	})
+}
+
+func TestDeleteByLegacyID(t *testing.T) {
+	forEachLegacyStore(t, func(t *testing.T, store legacyUserStore) {
+		ctx := context.Background()
+		createLegacyUser(t, store)
+		migrated, err := store.MigrateLegacyIDs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Delete(ctx, "alice"); err != nil {
+			t.Fatalf("Delete by old ID: %v", err)
+		}
+		for _, id := range []string{"alice", migrated["alice"]} {
+			if _, err := store.GetByID(ctx, id); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("GetByID(%q) after Delete = %v, want ErrUserNotFound", id, err)
+			}
+		}
+		if err := store.Delete(ctx, "alice"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("second Delete = %v, want ErrUserNotFound", err)
+		}
+
+		// Nothing of the user is left behind, so its username and OpenID are free again
+		if err := store.Create(ctx, &User{Username: "alice", Email: "alice@example.com", OpenID: "openid-alice"}); err != nil {
+			t.Errorf("Create after Delete: %v", err)
+		}
+	})
+}
+
+func TestRedisDeleteByLegacyIDRemovesAllKeys(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedis(t)
+	store := NewRedisUserStore(client)
+	createLegacyUser(t, store)
+	if _, err := store.MigrateLegacyIDs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := client.Keys(ctx, "*").Result(); err != nil || len(keys) != 0 {
+		t.Errorf("keys after Delete = %v, %v, want none", keys, err)
+	}
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// unlockScript deletes a lock only if it still holds the owner's value, so an
+// owner whose lock expired cannot release a lock taken by someone else.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// WeChatAccessTokenStore caches WeChat access_tokens in Redis, so all server
+// instances share one token per app, and provides the lock that lets only one
+// of them refresh it at a time
+type WeChatAccessTokenStore struct {
+	client *redis.Client
+}
+
+// NewWeChatAccessTokenStore creates a new WeChatAccessTokenStore
+func NewWeChatAccessTokenStore(client *redis.Client) *WeChatAccessTokenStore {
+	return &WeChatAccessTokenStore{
+		client: client,
+	}
+}
+
+// Get returns the app's cached access_token, or "" if there is none
+func (s *WeChatAccessTokenStore) Get(ctx context.Context, appID string) (string, error) {
+	token, err := s.client.Get(ctx, wechatAccessTokenKey(appID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get access token: %w", err)
+	}
+	return token, nil
+}
+
+// Set caches the app's access_token for ttl
+func (s *WeChatAccessTokenStore) Set(ctx context.Context, appID, token string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, wechatAccessTokenKey(appID), token, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store access token: %w", err)
+	}
+	return nil
+}
+
+// Lock tries to take the app's refresh lock, which expires after ttl in case
+// its owner dies. It reports whether the lock was taken and returns the
+// function that releases it.
+func (s *WeChatAccessTokenStore) Lock(ctx context.Context, appID string, ttl time.Duration) (func(), bool, error) {
+	key := wechatAccessTokenLockKey(appID)
+	owner := uuid.NewString()
+
+	ok, err := s.client.SetNX(ctx, key, owner, ttl).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to take access token lock: %w", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	unlock := func() {
+		// Release even if the caller's context was cancelled meanwhile
+		unlockScript.Run(context.Background(), s.client, []string{key}, owner)
+	}
+	return unlock, true, nil
+}
+
+func wechatAccessTokenKey(appID string) string {
+	return fmt.Sprintf("wechat_access_token:%s", appID)
+}
+
+func wechatAccessTokenLockKey(appID string) string {
+	return fmt.Sprintf("wechat_access_token_lock:%s", appID)
+}
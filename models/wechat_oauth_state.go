@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrOAuthStateNotFound is returned when an OAuth2 state is unknown, expired
+// or already used
+var ErrOAuthStateNotFound = errors.New("OAuth state not found")
+
+// ErrWeChatLoginNotFound is returned when a web login code is unknown,
+// expired or already used
+var ErrWeChatLoginNotFound = errors.New("WeChat login not found")
+
+// WeChatOAuthState is a WeChat web login in progress
+type WeChatOAuthState struct {
+	// App is the Official Account the user is logging in with
+	App   string `json:"app"`
+	Scope string `json:"scope"`
+	// ReturnURL is the H5 page the user is sent back to
+	ReturnURL string `json:"return_url"`
+}
+
+// WeChatWebLogin is a finished WeChat web login whose tokens the H5 page has
+// not picked up yet
+type WeChatWebLogin struct {
+	UserID string `json:"user_id"`
+	App    string `json:"app"`
+}
+
+// WeChatOAuthStateStore keeps the state parameter of WeChat web logins in
+// progress, so a callback is only accepted for a login this server started
+// and only once, and the one-time codes of finished logins
+type WeChatOAuthStateStore struct {
+	client *redis.Client
+}
+
+// NewWeChatOAuthStateStore creates a new WeChatOAuthStateStore
+func NewWeChatOAuthStateStore(client *redis.Client) *WeChatOAuthStateStore {
+	return &WeChatOAuthStateStore{
+		client: client,
+	}
+}
+
+// Save records a login started with state
+func (s *WeChatOAuthStateStore) Save(ctx context.Context, state string, login *WeChatOAuthState, ttl time.Duration) error {
+	data, err := json.Marshal(login)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OAuth state: %w", err)
+	}
+	if err := s.client.Set(ctx, wechatOAuthStateKey(state), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store OAuth state: %w", err)
+	}
+	return nil
+}
+
+// Consume removes state and returns the login it was saved for
+func (s *WeChatOAuthStateStore) Consume(ctx context.Context, state string) (*WeChatOAuthState, error) {
+	data, err := s.client.GetDel(ctx, wechatOAuthStateKey(state)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrOAuthStateNotFound
+		}
+		return nil, fmt.Errorf("failed to get OAuth state: %w", err)
+	}
+
+	var login WeChatOAuthState
+	if err := json.Unmarshal(data, &login); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal OAuth state: %w", err)
+	}
+	return &login, nil
+}
+
+// SaveLogin records a finished login under a one-time code
+func (s *WeChatOAuthStateStore) SaveLogin(ctx context.Context, code string, login *WeChatWebLogin, ttl time.Duration) error {
+	data, err := json.Marshal(login)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WeChat login: %w", err)
+	}
+	if err := s.client.Set(ctx, wechatLoginKey(code), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store WeChat login: %w", err)
+	}
+	return nil
+}
+
+// ConsumeLogin removes code and returns the login it was saved for
+func (s *WeChatOAuthStateStore) ConsumeLogin(ctx context.Context, code string) (*WeChatWebLogin, error) {
+	data, err := s.client.GetDel(ctx, wechatLoginKey(code)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrWeChatLoginNotFound
+		}
+		return nil, fmt.Errorf("failed to get WeChat login: %w", err)
+	}
+
+	var login WeChatWebLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal WeChat login: %w", err)
+	}
+	return &login, nil
+}
+
+func wechatOAuthStateKey(state string) string {
+	return fmt.Sprintf("wechat_oauth_state:%s", state)
+}
+
+func wechatLoginKey(code string) string {
+	return fmt.Sprintf("wechat_oauth_login:%s", code)
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrSessionKeyNotFound is returned when a user has no WeChat session_key,
+// either because it expired or because the user never logged in with WeChat
+var ErrSessionKeyNotFound = errors.New("WeChat session key not found")
+
+// WeChatSessionKeyStore keeps the session_key returned by WeChat's
+// code2session API, which decrypts and verifies data from the Mini Program.
+// It is stored per user and app and must never be sent to clients.
+type WeChatSessionKeyStore struct {
+	client *redis.Client
+}
+
+// NewWeChatSessionKeyStore creates a new WeChatSessionKeyStore
+func NewWeChatSessionKeyStore(client *redis.Client) *WeChatSessionKeyStore {
+	return &WeChatSessionKeyStore{
+		client: client,
+	}
+}
+
+// Store records the user's latest session_key for app, replacing the previous one
+func (s *WeChatSessionKeyStore) Store(ctx context.Context, app, userID, sessionKey string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, wechatSessionKeyKey(app, userID), sessionKey, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store session key: %w", err)
+	}
+	return nil
+}
+
+// Get returns the user's session_key for app
+func (s *WeChatSessionKeyStore) Get(ctx context.Context, app, userID string) (string, error) {
+	sessionKey, err := s.client.Get(ctx, wechatSessionKeyKey(app, userID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", ErrSessionKeyNotFound
+		}
+		return "", fmt.Errorf("failed to get session key: %w", err)
+	}
+	return sessionKey, nil
+}
+
+// wechatSessionKeyKey is the key of a user's session_key. The default app
+// keeps the key from before apps were configurable.
+func wechatSessionKeyKey(app, userID string) string {
+	if app == config.DefaultWeChatApp {
+		return fmt.Sprintf("wechat_session_key:%s", userID)
+	}
+	return fmt.Sprintf("wechat_session_key:%s:%s", app, userID)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// openRedis connects to the configured Redis server, which holds sessions,
+// tokens and caches. The memory storage driver is for running without any
+// services, so it gets an in-process Redis instead that, like the users, is
+// lost on restart. It is only built in with the memredis build tag. The
+// returned function releases the connection.
+func openRedis(ctx context.Context, cfg *config.Config) (*redis.Client, func(), error) {
+	if cfg.Storage.Driver == config.StorageDriverMemory {
+		addr, stop, err := startInProcessRedis()
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Println("Using in-process Redis, sessions and tokens are lost on restart")
+
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		return client, func() {
+			client.Close()
+			stop()
+		}, nil
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+
+	// Ping Redis to check connection
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	log.Println("Connected to Redis")
+
+	return client, func() { client.Close() }, nil
+}
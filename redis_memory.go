@@ -0,0 +1,19 @@
+//go:build memredis
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// startInProcessRedis starts an in-process Redis for the memory storage
+// driver and returns its address and a function that stops it.
+func startInProcessRedis() (string, func(), error) {
+	server, err := miniredis.Run()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start in-process Redis: %w", err)
+	}
+	return server.Addr(), server.Close, nil
+}
@@ -0,0 +1,11 @@
+//go:build !memredis
+
+package main
+
+import "errors"
+
+// startInProcessRedis is only available in binaries built with the memredis
+// tag, which keeps the in-process Redis out of production builds.
+func startInProcessRedis() (string, func(), error) {
+	return "", nil, errors.New(`the memory storage driver needs a binary built with "-tags memredis"`)
+}
@@ -1,14 +1,27 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/LIUHUANUCAS/auth/config"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+func init() {
+	// Time claims are kept to the millisecond instead of the second, so a
+	// token issued right after all of a user's tokens were revoked has a
+	// later iat than the revocation
+	jwt.TimePrecision = time.Millisecond
+}
+
 // TokenType defines the type of token
 type TokenType string
 
@@ -23,59 +36,237 @@ const (
 type Claims struct {
 	UserID string    `json:"user_id"`
 	Type   TokenType `json:"type"`
+	// FamilyID links the refresh tokens produced by rotating one another. It
+	// is the ID of the login session, which access tokens carry too.
+	FamilyID string `json:"fid,omitempty"`
+	// WeChatApp is the WeChat app the user logged in from, if any
+	WeChatApp string `json:"wechat_app,omitempty"`
+	// Roles are the user's roles when the access token was issued
+	Roles []string `json:"roles,omitempty"`
+	// Scope is the space separated list of scopes an access token grants. On
+	// a refresh token issued to an OAuth2 client it is what the user consented
+	// to, which caps the scopes of the access tokens it is refreshed into.
+	Scope string `json:"scope,omitempty"`
+	// ClientID is the OAuth2 client a token was issued to. Tokens from the
+	// client credentials grant act for the client, not a user, and carry it as
+	// their subject too.
+	ClientID string `json:"client_id,omitempty"`
+	// Downscoped marks access tokens made from another token by narrowing its
+	// scopes. They keep its session so they are revoked with it, but cannot
+	// manage the account.
+	Downscoped bool `json:"downscoped,omitempty"`
+	// APIKeyID is the API key a down-scoped token was made from. The token
+	// stops working when the key is revoked.
+	APIKeyID string `json:"api_key_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// HasRole reports whether the token carries role
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+// Scopes returns the scopes the token grants
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasScope reports whether the token grants scope
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes(), scope)
+}
+
 // JWTManager handles JWT operations
 type JWTManager struct {
 	config *config.JWTConfig
+
+	mu   sync.RWMutex
+	keys *keySet
 }
 
-// NewJWTManager creates a new JWTManager
-func NewJWTManager(config *config.JWTConfig) *JWTManager {
+// NewJWTManager creates a new JWTManager, loading the configured signing and verification keys
+func NewJWTManager(config *config.JWTConfig) (*JWTManager, error) {
+	keys, err := loadKeySet(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &JWTManager{
 		config: config,
+		keys:   keys,
+	}, nil
+}
+
+// ReloadKeys replaces the signing and verification keys with the ones described
+// by cfg. Tokens signed by keys still listed in cfg remain valid, so keys can be
+// rotated without a restart. On error the current keys are kept.
+func (m *JWTManager) ReloadKeys(cfg *config.JWTConfig) error {
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		return err
 	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.mu.Unlock()
+
+	return nil
 }
 
-// GenerateAccessToken generates a new access token
-func (m *JWTManager) GenerateAccessToken(userID string) (string, error) {
-	return m.generateToken(userID, AccessToken, m.config.AccessTokenTTL)
+// JWKS returns the public verification keys as a JSON Web Key Set.
+// Symmetric (HS256) keys are never included.
+func (m *JWTManager) JWKS() JWKS {
+	m.mu.RLock()
+	keys := m.keys
+	m.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	if jwk, ok := keys.active.publicJWK(); ok {
+		set.Keys = append(set.Keys, jwk)
+	}
+	ids := make([]string, 0, len(keys.byID))
+	for id := range keys.byID {
+		if id != keys.active.id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if jwk, ok := keys.byID[id].publicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
 }
 
-// GenerateRefreshToken generates a new refresh token
-func (m *JWTManager) GenerateRefreshToken(userID string) (string, error) {
-	return m.generateToken(userID, RefreshToken, m.config.RefreshTokenTTL)
+// AccessTokenTTL returns the lifetime of access tokens
+func (m *JWTManager) AccessTokenTTL() time.Duration {
+	return m.config.AccessTokenTTL
 }
 
-// generateToken generates a new token
-func (m *JWTManager) generateToken(userID string, tokenType TokenType, ttl time.Duration) (string, error) {
-	now := time.Now()
-	claims := &Claims{
-		UserID: userID,
-		Type:   tokenType,
+// RefreshTokenTTL returns the lifetime of refresh tokens
+func (m *JWTManager) RefreshTokenTTL() time.Duration {
+	return m.config.RefreshTokenTTL
+}
+
+// ScopesFor returns the scopes a user with roles is entitled to
+func (m *JWTManager) ScopesFor(roles []string) []string {
+	return m.config.ScopesFor(roles)
+}
+
+// GenerateAccessToken generates a new access token carrying the user ID,
+// session, WeChat app, roles, scope, client, API key and down-scoping of
+// claims. If claims.ExpiresAt is set and comes before the access token TTL is
+// up, the token expires then instead.
+func (m *JWTManager) GenerateAccessToken(claims Claims) (string, error) {
+	ttl := m.config.AccessTokenTTL
+	if claims.ExpiresAt != nil {
+		ttl = min(ttl, time.Until(claims.ExpiresAt.Time))
+	}
+	return m.generateToken(&Claims{
+		UserID:     claims.UserID,
+		Type:       AccessToken,
+		FamilyID:   claims.FamilyID,
+		WeChatApp:  claims.WeChatApp,
+		Roles:      claims.Roles,
+		Scope:      claims.Scope,
+		ClientID:   claims.ClientID,
+		Downscoped: claims.Downscoped,
+		APIKeyID:   claims.APIKeyID,
+	}, ttl)
+}
+
+// GenerateClientToken generates an access token for an OAuth2 client acting
+// for itself, with the client as its subject and no user
+func (m *JWTManager) GenerateClientToken(clientID, scope string) (string, error) {
+	return m.generateToken(&Claims{
+		Type:     AccessToken,
+		Scope:    scope,
+		ClientID: clientID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			NotBefore: jwt.NewNumericDate(now),
+			Subject: clientID,
 		},
+	}, m.config.AccessTokenTTL)
+}
+
+// GenerateRefreshToken generates a new refresh token carrying the user ID,
+// token family, WeChat app, client and consented scope of claims. These are
+// carried over to the tokens it is exchanged for; roles are looked up again
+// instead, so changes to them apply on the next refresh.
+func (m *JWTManager) GenerateRefreshToken(claims Claims) (string, error) {
+	return m.generateToken(&Claims{
+		UserID:    claims.UserID,
+		Type:      RefreshToken,
+		FamilyID:  claims.FamilyID,
+		WeChatApp: claims.WeChatApp,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+	}, m.config.RefreshTokenTTL)
+}
+
+// NewRandomID returns a random 128-bit hex encoded identifier
+func NewRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// generateToken signs the claims with the active key, filling in a unique jti
+// and the time based claims
+func (m *JWTManager) generateToken(claims *Claims, ttl time.Duration) (string, error) {
+	m.mu.RLock()
+	key := m.keys.active
+	m.mu.RUnlock()
+
+	if key.signKey == nil {
+		return "", errors.New("no signing key configured")
+	}
+
+	jti, err := NewRandomID()
+	if err != nil {
+		return "", err
 	}
+	claims.ID = jti
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(m.config.SecretKey))
+	now := time.Now()
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+	return token.SignedString(key.signKey)
 }
 
-// ValidateToken validates a token and returns the claims
+// ValidateToken validates a token and returns the claims.
+// The verification key is chosen by the kid header; tokens without a kid are
+// checked against the active key.
 func (m *JWTManager) ValidateToken(tokenString string) (*Claims, error) {
+	m.mu.RLock()
+	keys := m.keys
+	m.mu.RUnlock()
+
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&Claims{},
 		func(token *jwt.Token) (interface{}, error) {
+			key := keys.active
+			if kid, ok := token.Header["kid"].(string); ok {
+				if key, ok = keys.byID[kid]; !ok {
+					return nil, fmt.Errorf("unknown key ID: %s", kid)
+				}
+			}
+
 			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			if token.Method.Alg() != key.method.Alg() {
 				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 			}
-			return []byte(m.config.SecretKey), nil
+			return key.verifyKey, nil
 		},
 	)
 
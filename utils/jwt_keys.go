@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/LIUHUANUCAS/auth/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is a single key identified by its kid
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keySet holds the active signing key and every key accepted for verification
+type keySet struct {
+	active *jwtKey
+	byID   map[string]*jwtKey
+}
+
+// JWK is a JSON Web Key as defined in RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set as defined in RFC 7517
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// loadKeySet builds the key set from the configuration. The active key is
+// described by Algorithm/SecretKey/PrivateKeyFile/PublicKeyFile and KeyID;
+// VerificationKeys lists retired keys that are still accepted.
+func loadKeySet(cfg *config.JWTConfig) (*keySet, error) {
+	active, err := loadKey(cfg.KeyID, cfg.Algorithm, cfg.SecretKey, cfg.PrivateKeyFile, cfg.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &keySet{
+		active: active,
+		byID:   map[string]*jwtKey{active.id: active},
+	}
+
+	for _, kc := range cfg.VerificationKeys {
+		alg := kc.Algorithm
+		if alg == "" {
+			alg = cfg.Algorithm
+		}
+		key, err := loadKey(kc.ID, alg, kc.SecretKey, "", kc.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("verification key %q: %w", kc.ID, err)
+		}
+		if _, exists := set.byID[key.id]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", key.id)
+		}
+		set.byID[key.id] = key
+	}
+
+	return set, nil
+}
+
+// loadKey loads one key. For HS256 both the signing and verification keys are
+// the shared secret. For asymmetric algorithms the private key is loaded from
+// privateKeyFile and the public key either from publicKeyFile or derived from
+// the private key. With only a public key the key can verify but not sign.
+// When id is empty, asymmetric keys get their RFC 7638 thumbprint as key ID.
+func loadKey(id, alg, secret, privateKeyFile, publicKeyFile string) (*jwtKey, error) {
+	method, err := signingMethodFor(alg)
+	if err != nil {
+		return nil, err
+	}
+	key := &jwtKey{id: id, method: method}
+
+	if alg == config.AlgorithmHS256 {
+		key.signKey = []byte(secret)
+		key.verifyKey = []byte(secret)
+		return key, nil
+	}
+
+	if privateKeyFile != "" {
+		priv, err := loadPrivateKey(alg, privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = priv
+		key.verifyKey = priv.Public()
+	}
+
+	if publicKeyFile != "" {
+		key.verifyKey, err = loadPublicKey(alg, publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("%s requires a private or public key file", alg)
+	}
+
+	if key.id == "" {
+		key.id, err = thumbprint(key.verifyKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// signingMethodFor returns the JWT signing method for a configured algorithm
+func signingMethodFor(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case config.AlgorithmHS256:
+		return jwt.SigningMethodHS256, nil
+	case config.AlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	case config.AlgorithmES256:
+		return jwt.SigningMethodES256, nil
+	case config.AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm: %q", alg)
+	}
+}
+
+// loadPrivateKey reads a PEM encoded private key for the given algorithm
+func loadPrivateKey(alg, path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	switch alg {
+	case config.AlgorithmRS256:
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+		}
+		return key, nil
+	case config.AlgorithmES256:
+		key, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EC private key: %w", err)
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 requires a P-256 key, got %s", key.Curve.Params().Name)
+		}
+		return key, nil
+	case config.AlgorithmEdDSA:
+		key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Ed25519 private key: %w", err)
+		}
+		return key.(crypto.Signer), nil
+	default:
+		return nil, fmt.Errorf("algorithm %q does not use a private key", alg)
+	}
+}
+
+// loadPublicKey reads a PEM encoded public key for the given algorithm
+func loadPublicKey(alg, path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	switch alg {
+	case config.AlgorithmRS256:
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+		}
+		return key, nil
+	case config.AlgorithmES256:
+		key, err := jwt.ParseECPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EC public key: %w", err)
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 requires a P-256 key, got %s", key.Curve.Params().Name)
+		}
+		return key, nil
+	case config.AlgorithmEdDSA:
+		key, err := jwt.ParseEdPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Ed25519 public key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("algorithm %q does not use a public key", alg)
+	}
+}
+
+// publicJWK returns the public JWK for a key, or false for symmetric keys
+// which must never be published
+func (k *jwtKey) publicJWK() (JWK, bool) {
+	jwk, err := toJWK(k.verifyKey)
+	if err != nil {
+		return JWK{}, false
+	}
+	jwk.KeyID = k.id
+	jwk.Use = "sig"
+	jwk.Algorithm = k.method.Alg()
+	return jwk, true
+}
+
+// toJWK converts a public key to its JWK representation
+func toJWK(pub interface{}) (JWK, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType: "RSA",
+			N:       b64(key.N.Bytes()),
+			E:       b64(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			KeyType: "EC",
+			Curve:   key.Curve.Params().Name,
+			X:       b64(key.X.FillBytes(make([]byte, size))),
+			Y:       b64(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       b64(key),
+		}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of a public key
+func thumbprint(pub interface{}) (string, error) {
+	jwk, err := toJWK(pub)
+	if err != nil {
+		return "", err
+	}
+
+	// Required members only, in lexicographic order
+	var canonical string
+	switch jwk.KeyType {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Curve, jwk.X, jwk.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Curve, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:]), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// PKCEMethodS256 is the only PKCE code challenge method accepted (RFC 7636)
+const PKCEMethodS256 = "S256"
+
+// ValidCodeVerifier reports whether verifier is a well-formed PKCE code
+// verifier: 43 to 128 unreserved characters
+func ValidCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, r := range verifier {
+		if !isUnreserved(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidCodeChallenge reports whether challenge is a well-formed S256 code
+// challenge: a base64url encoded SHA-256 hash without padding
+func ValidCodeChallenge(challenge string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(b) == sha256.Size
+}
+
+// VerifyPKCE reports whether verifier is the code verifier behind the S256
+// code challenge
+func VerifyPKCE(verifier, challenge string) bool {
+	if !ValidCodeVerifier(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// isUnreserved reports whether r is an unreserved URI character (RFC 3986)
+func isUnreserved(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' ||
+		r == '-' || r == '.' || r == '_' || r == '~'
+}
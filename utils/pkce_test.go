@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// The example from RFC 7636 appendix B
+const (
+	rfcVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfcChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	long := strings.Repeat("a", 128)
+	sum := sha256.Sum256([]byte(long))
+	longChallenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"RFC 7636 example", rfcVerifier, rfcChallenge, true},
+		{"longest verifier", long, longChallenge, true},
+		{"other verifier", strings.Repeat("a", 43), rfcChallenge, false},
+		{"plain method", rfcVerifier, rfcVerifier, false},
+		{"padded challenge", rfcVerifier, rfcChallenge + "=", false},
+		{"standard base64 challenge", rfcVerifier, strings.NewReplacer("-", "+", "_", "/").Replace(rfcChallenge), false},
+		{"empty verifier", "", rfcChallenge, false},
+		{"empty challenge", rfcVerifier, "", false},
+		{"verifier too long", long + "a", longChallenge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPKCE(tt.verifier, tt.challenge); got != tt.want {
+				t.Errorf("VerifyPKCE(%q, %q) = %v, want %v", tt.verifier, tt.challenge, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidCodeVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		want     bool
+	}{
+		{"RFC 7636 example", rfcVerifier, true},
+		{"shortest", strings.Repeat("a", 43), true},
+		{"longest", strings.Repeat("a", 128), true},
+		{"unreserved characters", strings.Repeat("aZ09-._~", 6), true},
+		{"too short", strings.Repeat("a", 42), false},
+		{"too long", strings.Repeat("a", 129), false},
+		{"reserved character", strings.Repeat("a", 42) + "+", false},
+		{"space", strings.Repeat("a", 42) + " ", false},
+		{"non-ASCII", strings.Repeat("a", 42) + "é", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidCodeVerifier(tt.verifier); got != tt.want {
+				t.Errorf("ValidCodeVerifier(%q) = %v, want %v", tt.verifier, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidCodeChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		want      bool
+	}{
+		{"RFC 7636 example", rfcChallenge, true},
+		{"padded", rfcChallenge + "=", false},
+		{"too short", rfcChallenge[:42], false},
+		{"not base64url", strings.Repeat("!", 43), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidCodeChallenge(tt.challenge); got != tt.want {
+				t.Errorf("ValidCodeChallenge(%q) = %v, want %v", tt.challenge, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,34 +1,163 @@
 package utils
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/LIUHUANUCAS/auth/config"
 )
 
+// Paths of the WeChat server APIs, relative to WeChatConfig.APIBaseURL
 const (
-	// WeChatCode2SessionURL is the URL to exchange code for session info
-	WeChatCode2SessionURL = "https://api.weixin.qq.com/sns/jscode2session?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code"
+	// WeChatCode2SessionPath exchanges a wx.login code for session info
+	WeChatCode2SessionPath = "/sns/jscode2session"
+	// WeChatStableTokenPath issues the app's access_token. Unlike /cgi-bin/token
+	// it does not invalidate the previous token on every call.
+	WeChatStableTokenPath = "/cgi-bin/stable_token"
+	// WeChatPhoneNumberPath exchanges a getPhoneNumber code for the user's phone number
+	WeChatPhoneNumberPath = "/wxa/business/getuserphonenumber"
 )
 
-// WeChatManager handles WeChat API operations
+// WeChat errcodes the server handles
+const (
+	// errCodeSystemBusy is returned while WeChat is busy; the call may be retried
+	errCodeSystemBusy = -1
+	// errCodeInvalidCredential and errCodeAccessTokenExpired tell that the
+	// access_token is invalid or has expired
+	errCodeInvalidCredential  = 40001
+	errCodeAccessTokenExpired = 42001
+	// errCodeInvalidCode and errCodeCodeUsed reject the code a client sent
+	errCodeInvalidCode = 40029
+	errCodeCodeUsed    = 40163
+	// errCodeHighRiskUser is returned for users WeChat flags as risky
+	errCodeHighRiskUser = 40226
+	// errCodeRateLimited is returned when the app exceeds its API quota
+	errCodeRateLimited = 45011
+)
+
+var (
+	// ErrInvalidCode is returned when WeChat rejects a code as invalid or used
+	ErrInvalidCode = errors.New("invalid WeChat code")
+	// ErrRateLimited is returned when WeChat rate limits the app
+	ErrRateLimited = errors.New("WeChat rate limit reached")
+	// ErrHighRiskUser is returned when WeChat refuses to log in a risky user
+	ErrHighRiskUser = errors.New("WeChat user is blocked as high risk")
+	// ErrWeChatUnavailable is returned when WeChat cannot be reached or keeps
+	// failing, or while the circuit breaker stops calls to it
+	ErrWeChatUnavailable = errors.New("WeChat is unavailable")
+)
+
+const (
+	// accessTokenMargin is how long before its expiry the access_token is
+	// renewed. The stable_token API hands out a new token in the last five
+	// minutes, while the old one keeps working.
+	accessTokenMargin = 5 * time.Minute
+	// accessTokenLockTTL bounds how long a crashed instance can block refreshes
+	accessTokenLockTTL = 10 * time.Second
+	// accessTokenPollInterval is how often an instance waiting for another
+	// one's refresh checks the cache
+	accessTokenPollInterval = 100 * time.Millisecond
+	// retryBackoff is the wait before the first retry of a call; it doubles
+	// with every further retry
+	retryBackoff = 100 * time.Millisecond
+)
+
+// AccessTokenCache shares access_tokens between server instances and
+// serializes their refreshes
+type AccessTokenCache interface {
+	// Get returns the app's cached access_token, or "" if there is none
+	Get(ctx context.Context, appID string) (string, error)
+	// Set caches the app's access_token for ttl
+	Set(ctx context.Context, appID, token string, ttl time.Duration) error
+	// Lock tries to take the app's refresh lock for at most ttl, reporting
+	// whether it was taken and returning the function that releases it
+	Lock(ctx context.Context, appID string, ttl time.Duration) (func(), bool, error)
+}
+
+// ErrUnknownApp is returned for a WeChat app that is not configured or is
+// not of the type an API needs
+var ErrUnknownApp = errors.New("unknown WeChat app")
+
+// WeChatManager handles WeChat API operations for the configured apps.
+// Methods take the app's name, or "" for the default app.
 type WeChatManager struct {
 	config *config.WeChatConfig
 	client *http.Client
+	tokens AccessTokenCache
+
+	// refreshMu lets one goroutine per instance refresh access_tokens
+	refreshMu sync.Mutex
+	breaker   circuitBreaker
 }
 
-// NewWeChatManager creates a new WeChatManager
-func NewWeChatManager(config *config.WeChatConfig) *WeChatManager {
+// NewWeChatManager creates a new WeChatManager that keeps access_tokens in tokens
+func NewWeChatManager(config *config.WeChatConfig, tokens AccessTokenCache) *WeChatManager {
 	return &WeChatManager{
 		config: config,
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		client: &http.Client{},
+		tokens: tokens,
+	}
+}
+
+// SessionKeyTTL returns how long a user's session_key is kept
+func (m *WeChatManager) SessionKeyTTL() time.Duration {
+	return m.config.SessionKeyTTL
+}
+
+// OAuthStateTTL returns how long a web login may take from authorize to callback
+func (m *WeChatManager) OAuthStateTTL() time.Duration {
+	return m.config.OAuthStateTTL
+}
+
+// App returns the name of the app called name, or of the default app when
+// name is empty, checking that it is of type appType
+func (m *WeChatManager) App(name, appType string) (string, error) {
+	name, _, err := m.app(name, appType)
+	return name, err
+}
+
+// app looks up the app called name, or the default app when name is empty
+func (m *WeChatManager) app(name, appType string) (string, config.WeChatAppConfig, error) {
+	name, app, ok := m.config.App(name)
+	if !ok || app.Type != appType {
+		return "", config.WeChatAppConfig{}, fmt.Errorf("%w: %q", ErrUnknownApp, name)
+	}
+	return name, app, nil
+}
+
+// APIError is an error reported by a WeChat API in its errcode and errmsg fields
+type APIError struct {
+	Code int
+	Msg  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("WeChat API error: %d - %s", e.Code, e.Msg)
+}
+
+// Unwrap returns the error the server reports for the errcode, so callers
+// can match it with errors.Is
+func (e *APIError) Unwrap() error {
+	switch e.Code {
+	case errCodeInvalidCode, errCodeCodeUsed:
+		return ErrInvalidCode
+	case errCodeRateLimited:
+		return ErrRateLimited
+	case errCodeHighRiskUser:
+		return ErrHighRiskUser
+	case errCodeSystemBusy:
+		return ErrWeChatUnavailable
 	}
+	return nil
 }
 
 // Code2SessionResponse represents the response from the code2session API
@@ -40,34 +169,284 @@ type Code2SessionResponse struct {
 	ErrMsg     string `json:"errmsg"`
 }
 
-// Code2Session exchanges a code for session information
-func (m *WeChatManager) Code2Session(code string) (*Code2SessionResponse, error) {
-	// Build the URL
-	url := fmt.Sprintf(WeChatCode2SessionURL, m.config.AppID, m.config.AppSecret, code)
+// Code2Session exchanges a code from a Mini Program for session information
+func (m *WeChatManager) Code2Session(ctx context.Context, appName, code string) (*Code2SessionResponse, error) {
+	_, app, err := m.app(appName, config.WeChatAppMiniProgram)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"appid":      {app.AppID},
+		"secret":     {app.AppSecret},
+		"js_code":    {code},
+		"grant_type": {"authorization_code"},
+	}
+
+	var sessionResp Code2SessionResponse
+	if err := m.call(ctx, http.MethodGet, WeChatCode2SessionPath, query, nil, &sessionResp); err != nil {
+		return nil, err
+	}
+
+	return &sessionResp, nil
+}
+
+// PhoneInfo is the phone number returned by the getuserphonenumber API
+type PhoneInfo struct {
+	PhoneNumber     string          `json:"phoneNumber"`
+	PurePhoneNumber string          `json:"purePhoneNumber"`
+	CountryCode     string          `json:"countryCode"`
+	Watermark       WeChatWatermark `json:"watermark"`
+}
+
+// E164 returns the phone number as +<country code><number>
+func (p *PhoneInfo) E164() string {
+	return "+" + strings.TrimPrefix(p.CountryCode, "+") + p.PurePhoneNumber
+}
+
+// GetPhoneNumber exchanges a code from the Mini Program's getPhoneNumber
+// button for the user's verified phone number
+func (m *WeChatManager) GetPhoneNumber(ctx context.Context, appName, code string) (*PhoneInfo, error) {
+	_, app, err := m.app(appName, config.WeChatAppMiniProgram)
+	if err != nil {
+		return nil, err
+	}
+
+	var phoneResp struct {
+		PhoneInfo PhoneInfo `json:"phone_info"`
+	}
+	body := map[string]string{"code": code}
+	if err := m.callWithAccessToken(ctx, app, http.MethodPost, WeChatPhoneNumberPath, url.Values{}, body, &phoneResp); err != nil {
+		return nil, err
+	}
+
+	info := &phoneResp.PhoneInfo
+	if info.PurePhoneNumber == "" {
+		return nil, fmt.Errorf("WeChat API returned no phone number")
+	}
+	if info.Watermark.AppID != app.AppID {
+		return nil, ErrWatermarkMismatch
+	}
+
+	return info, nil
+}
+
+// AccessToken returns the app's access_token, fetching one when the shared
+// cache has none
+func (m *WeChatManager) AccessToken(ctx context.Context, appName string) (string, error) {
+	_, app, err := m.app(appName, config.WeChatAppMiniProgram)
+	if err != nil {
+		return "", err
+	}
+	return m.accessToken(ctx, app)
+}
+
+// accessToken returns the app's cached access_token or fetches one
+func (m *WeChatManager) accessToken(ctx context.Context, app config.WeChatAppConfig) (string, error) {
+	token, err := m.tokens.Get(ctx, app.AppID)
+	if err != nil || token != "" {
+		return token, err
+	}
+	return m.refreshAccessToken(ctx, app, "")
+}
+
+// refreshAccessToken fetches a new access_token while holding the app's
+// refresh lock, unless another instance cached one meanwhile. stale is a
+// token WeChat rejected; it is replaced even though it is still cached.
+func (m *WeChatManager) refreshAccessToken(ctx context.Context, app config.WeChatAppConfig, stale string) (string, error) {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+
+	for {
+		unlock, ok, err := m.tokens.Lock(ctx, app.AppID, accessTokenLockTTL)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			defer unlock()
+		}
+
+		token, err := m.tokens.Get(ctx, app.AppID)
+		if err != nil {
+			return "", err
+		}
+		if token != "" && token != stale {
+			return token, nil
+		}
+		if ok {
+			return m.fetchAccessToken(ctx, app, stale != "")
+		}
+
+		// Another instance is refreshing; wait for its token
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(accessTokenPollInterval):
+		}
+	}
+}
+
+// fetchAccessToken gets an access_token from the stable_token API and caches
+// it until shortly before it expires. force makes WeChat issue a new token
+// even if the current one has not expired.
+func (m *WeChatManager) fetchAccessToken(ctx context.Context, app config.WeChatAppConfig, force bool) (string, error) {
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	body := map[string]any{
+		"grant_type":    "client_credential",
+		"appid":         app.AppID,
+		"secret":        app.AppSecret,
+		"force_refresh": force,
+	}
+	if err := m.call(ctx, http.MethodPost, WeChatStableTokenPath, url.Values{}, body, &tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.AccessToken == "" {
+		return "", errors.New("WeChat API returned no access token")
+	}
+
+	expiresIn := time.Duration(tokenResp.ExpiresIn) * time.Second
+	ttl := expiresIn - accessTokenMargin
+	if ttl <= 0 {
+		ttl = expiresIn / 2
+	}
+	if err := m.tokens.Set(ctx, app.AppID, tokenResp.AccessToken, ttl); err != nil {
+		return "", err
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// callWithAccessToken calls a WeChat API that needs the app's access_token.
+// If WeChat rejects the token, it is refreshed and the call retried once.
+func (m *WeChatManager) callWithAccessToken(ctx context.Context, app config.WeChatAppConfig, method, path string, query url.Values, body, out any) error {
+	token, err := m.accessToken(ctx, app)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		query.Set("access_token", token)
+		err := m.call(ctx, method, path, query, body, out)
+
+		var apiErr *APIError
+		if attempt > 0 || !errors.As(err, &apiErr) ||
+			(apiErr.Code != errCodeInvalidCredential && apiErr.Code != errCodeAccessTokenExpired) {
+			return err
+		}
+
+		// The token was revoked, e.g. by a forced refresh elsewhere, or expired early
+		token, err = m.refreshAccessToken(ctx, app, token)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// call sends a request to a WeChat API and decodes the JSON response into
+// out. A non-nil body is sent as JSON. An errcode in the response is returned
+// as an *APIError. Transient failures are retried with backoff; when they
+// persist, or while the circuit breaker is open, the error wraps
+// ErrWeChatUnavailable.
+func (m *WeChatManager) call(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	if !m.breaker.allow() {
+		return ErrWeChatUnavailable
+	}
+
+	var err error
+	for attempt := 0; attempt < max(m.config.MaxAttempts, 1); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				m.breaker.release()
+				return ctx.Err()
+			case <-time.After(retryBackoff << (attempt - 1)):
+			}
+		}
+
+		var transient bool
+		transient, err = m.attempt(ctx, method, path, query, data, out)
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about WeChat
+			m.breaker.release()
+			return ctx.Err()
+		}
+		if !transient {
+			m.breaker.success()
+			return err
+		}
+	}
+
+	m.breaker.failure()
+	if errors.Is(err, ErrWeChatUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrWeChatUnavailable, err)
+}
+
+// attempt makes one call to a WeChat API, bounded by the request timeout. It
+// reports whether a failure is transient, so the call may be retried.
+func (m *WeChatManager) attempt(ctx context.Context, method, path string, query url.Values, data []byte, out any) (bool, error) {
+	if m.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.config.RequestTimeout)
+		defer cancel()
+	}
+
+	endpoint := strings.TrimSuffix(m.config.APIBaseURL, "/") + path + "?" + query.Encode()
+
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return false, fmt.Errorf("failed to build request: %w", err)
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	// Make the request
-	resp, err := m.client.Get(url)
+	resp, err := m.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request to WeChat API: %w", err)
+		return true, fmt.Errorf("failed to make request to WeChat API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return true, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return true, fmt.Errorf("WeChat API returned status %d", resp.StatusCode)
 	}
 
 	// Parse the response
-	var sessionResp Code2SessionResponse
-	if err := json.Unmarshal(body, &sessionResp); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	var status struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
 	}
-
-	// Check for errors
-	if sessionResp.ErrCode != 0 {
-		return nil, fmt.Errorf("WeChat API error: %d - %s", sessionResp.ErrCode, sessionResp.ErrMsg)
+	if err := json.Unmarshal(respBody, &status); err != nil {
+		return false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if status.ErrCode != 0 {
+		return status.ErrCode == errCodeSystemBusy, &APIError{Code: status.ErrCode, Msg: status.ErrMsg}
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return false, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return &sessionResp, nil
+	return false, nil
 }
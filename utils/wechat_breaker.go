@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is how many calls in a row must fail with transient
+	// errors before WeChat is considered down
+	breakerThreshold = 5
+	// breakerCooldown is how long calls fail fast once WeChat is considered
+	// down, before one call is let through to probe it
+	breakerCooldown = 30 * time.Second
+)
+
+// circuitBreaker stops calls to WeChat while it is down, so requests fail
+// fast instead of each waiting out its retries
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a call may be made. Once the cooldown is over it lets
+// a single call through; its outcome closes the breaker or opens it again.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < breakerCooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a call that reached WeChat, even if it answered an errcode
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a call that failed with transient errors
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= breakerThreshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a call whose outcome says nothing about WeChat, e.g. one the
+// caller cancelled, letting another call probe it
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
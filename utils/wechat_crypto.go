@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/LIUHUANUCAS/auth/config"
+)
+
+var (
+	// ErrInvalidEncryptedData is returned when encrypted data cannot be decrypted with the session key
+	ErrInvalidEncryptedData = errors.New("invalid encrypted data")
+	// ErrWatermarkMismatch is returned when decrypted data was produced for another app
+	ErrWatermarkMismatch = errors.New("encrypted data was not produced for this app")
+)
+
+// WeChatWatermark identifies the app and time decrypted data was produced for
+type WeChatWatermark struct {
+	AppID     string `json:"appid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// WeChatUserInfo is the user data encrypted by wx.getUserProfile and wx.getUserInfo
+type WeChatUserInfo struct {
+	OpenID    string          `json:"openId"`
+	UnionID   string          `json:"unionId"`
+	NickName  string          `json:"nickName"`
+	AvatarURL string          `json:"avatarUrl"`
+	Gender    int             `json:"gender"`
+	Language  string          `json:"language"`
+	City      string          `json:"city"`
+	Province  string          `json:"province"`
+	Country   string          `json:"country"`
+	Watermark WeChatWatermark `json:"watermark"`
+}
+
+// VerifySignature reports whether signature is WeChat's signature of rawData,
+// the hex SHA-1 of rawData followed by the session key
+func VerifySignature(rawData, signature, sessionKey string) bool {
+	sum := sha1.Sum([]byte(rawData + sessionKey))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) == 1
+}
+
+// DecryptData decrypts base64 encryptedData and iv from a Mini Program with
+// the user's session key (AES-128-CBC, PKCS#7 padding) and checks that its
+// watermark names that app. It returns the decrypted JSON.
+func (m *WeChatManager) DecryptData(appName, sessionKey, encryptedData, iv string) ([]byte, error) {
+	_, app, err := m.app(appName, config.WeChatAppMiniProgram)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(sessionKey)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("invalid session key")
+	}
+	ivBytes, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil || len(ivBytes) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: bad iv", ErrInvalidEncryptedData)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: bad ciphertext", ErrInvalidEncryptedData)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, ivBytes).CryptBlocks(plaintext, ciphertext)
+
+	plaintext, err = pkcs7Unpad(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Watermark WeChatWatermark `json:"watermark"`
+	}
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		// Garbage after decryption means the session key or iv did not match
+		return nil, fmt.Errorf("%w: not JSON", ErrInvalidEncryptedData)
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Watermark.AppID), []byte(app.AppID)) != 1 {
+		return nil, ErrWatermarkMismatch
+	}
+
+	return plaintext, nil
+}
+
+// pkcs7Unpad strips PKCS#7 padding. WeChat's reference code pads to 32 bytes,
+// so padding up to 32 bytes is accepted.
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > 32 || n > len(data) {
+		return nil, fmt.Errorf("%w: bad padding", ErrInvalidEncryptedData)
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, fmt.Errorf("%w: bad padding", ErrInvalidEncryptedData)
+		}
+	}
+	return data[:len(data)-n], nil
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/LIUHUANUCAS/auth/config"
+)
+
+const testAppID = "wx1111111111111111"
+
+var (
+	testSessionKey = bytes.Repeat([]byte{0x11}, 16)
+	testIV         = bytes.Repeat([]byte{0x22}, aes.BlockSize)
+)
+
+func newTestWeChatManager() *WeChatManager {
+	cfg := config.Default()
+	cfg.WeChat.AppID = testAppID
+	cfg.WeChat.AppSecret = "secret"
+	return NewWeChatManager(&cfg.WeChat, nil)
+}
+
+// encrypt encrypts plaintext like WeChat, padding it to a multiple of blockSize
+func encrypt(t *testing.T, key, iv, plaintext []byte, blockSize int) string {
+	t.Helper()
+	n := blockSize - len(plaintext)%blockSize
+	padded := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(n)}, n)...)
+	return encryptRaw(t, key, iv, padded)
+}
+
+// encryptRaw encrypts data that is already a multiple of the AES block size
+func encryptRaw(t *testing.T, key, iv, data []byte) string {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, data)
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func TestDecryptData(t *testing.T) {
+	m := newTestWeChatManager()
+	key := base64.StdEncoding.EncodeToString(testSessionKey)
+	iv := base64.StdEncoding.EncodeToString(testIV)
+	plaintext := []byte(`{"openId":"o1","nickName":"Alice","watermark":{"appid":"` + testAppID + `","timestamp":1700000000}}`)
+
+	for _, blockSize := range []int{aes.BlockSize, 32} {
+		got, err := m.DecryptData("", key, encrypt(t, testSessionKey, testIV, plaintext, blockSize), iv)
+		if err != nil {
+			t.Fatalf("DecryptData with %d byte padding: %v", blockSize, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("DecryptData with %d byte padding = %s, want %s", blockSize, got, plaintext)
+		}
+	}
+}
+
+func TestDecryptDataFailures(t *testing.T) {
+	m := newTestWeChatManager()
+	key := base64.StdEncoding.EncodeToString(testSessionKey)
+	iv := base64.StdEncoding.EncodeToString(testIV)
+	plaintext := []byte(`{"openId":"o1","watermark":{"appid":"` + testAppID + `","timestamp":1700000000}}`)
+	data := encrypt(t, testSessionKey, testIV, plaintext, aes.BlockSize)
+
+	otherKey := bytes.Repeat([]byte{0x33}, 16)
+	otherApp := []byte(`{"openId":"o1","watermark":{"appid":"wx2222222222222222","timestamp":1700000000}}`)
+	noWatermark := []byte(`{"openId":"o1"}`)
+	zeroPadding := append(bytes.Clone(plaintext[:32]), make([]byte, aes.BlockSize)...)
+	mixedPadding := append(bytes.Clone(plaintext[:32]), bytes.Repeat([]byte{4}, aes.BlockSize-1)...)
+	mixedPadding = append(mixedPadding, 3)
+	longPadding := append(bytes.Clone(plaintext[:16]), bytes.Repeat([]byte{48}, 48)...)
+
+	tests := []struct {
+		name       string
+		app        string
+		sessionKey string
+		data       string
+		iv         string
+		want       error
+	}{
+		{"unknown app", "other", key, data, iv, ErrUnknownApp},
+		{"wrong session key", "", base64.StdEncoding.EncodeToString(otherKey), data, iv, ErrInvalidEncryptedData},
+		{"wrong iv", "", key, data, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x44}, aes.BlockSize)), ErrInvalidEncryptedData},
+		{"short iv", "", key, data, base64.StdEncoding.EncodeToString(testIV[:8]), ErrInvalidEncryptedData},
+		{"iv not base64", "", key, data, "!!", ErrInvalidEncryptedData},
+		{"data not base64", "", key, "!!", iv, ErrInvalidEncryptedData},
+		{"empty data", "", key, "", iv, ErrInvalidEncryptedData},
+		{"partial block", "", key, base64.StdEncoding.EncodeToString([]byte("0123456789")), iv, ErrInvalidEncryptedData},
+		{"zero padding", "", key, encryptRaw(t, testSessionKey, testIV, zeroPadding), iv, ErrInvalidEncryptedData},
+		{"inconsistent padding", "", key, encryptRaw(t, testSessionKey, testIV, mixedPadding), iv, ErrInvalidEncryptedData},
+		{"padding over 32 bytes", "", key, encryptRaw(t, testSessionKey, testIV, longPadding), iv, ErrInvalidEncryptedData},
+		{"watermark of another app", "", key, encrypt(t, testSessionKey, testIV, otherApp, aes.BlockSize), iv, ErrWatermarkMismatch},
+		{"no watermark", "", key, encrypt(t, testSessionKey, testIV, noWatermark, aes.BlockSize), iv, ErrWatermarkMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.DecryptData(tt.app, tt.sessionKey, tt.data, tt.iv)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("DecryptData() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptDataInvalidSessionKey(t *testing.T) {
+	m := newTestWeChatManager()
+	iv := base64.StdEncoding.EncodeToString(testIV)
+	data := encrypt(t, testSessionKey, testIV, []byte(`{}`), aes.BlockSize)
+
+	for _, key := range []string{"", "!!", base64.StdEncoding.EncodeToString(testSessionKey[:8])} {
+		if _, err := m.DecryptData("", key, data, iv); err == nil {
+			t.Errorf("DecryptData with session key %q succeeded", key)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	// sha1("{}key")
+	const signature = "8c08a3948bb65361ca63a847ff71f1e19ee7aa74"
+	if !VerifySignature("{}", signature, "key") {
+		t.Error("VerifySignature rejected a valid signature")
+	}
+	if VerifySignature("{}", signature, "other") {
+		t.Error("VerifySignature accepted a signature made with another session key")
+	}
+	if VerifySignature(`{"a":1}`, signature, "key") {
+		t.Error("VerifySignature accepted a signature of other data")
+	}
+}
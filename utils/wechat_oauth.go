@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/LIUHUANUCAS/auth/config"
+)
+
+// Paths of the Official Account web OAuth2 APIs, relative to WeChatConfig.APIBaseURL
+const (
+	// WeChatOAuthTokenPath exchanges an OAuth2 code for the user's OpenID and web access token
+	WeChatOAuthTokenPath = "/sns/oauth2/access_token"
+	// WeChatOAuthUserInfoPath returns the profile of a user who granted snsapi_userinfo
+	WeChatOAuthUserInfoPath = "/sns/userinfo"
+)
+
+// Official Account OAuth2 scopes
+const (
+	// OAuthScopeBase silently identifies the user by OpenID
+	OAuthScopeBase = "snsapi_base"
+	// OAuthScopeUserInfo asks the user to share their profile as well
+	OAuthScopeUserInfo = "snsapi_userinfo"
+)
+
+// OAuthToken is the response of the OAuth2 access_token API. Its
+// AccessToken is specific to the user and unrelated to the app's access_token.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	OpenID       string `json:"openid"`
+	Scope        string `json:"scope"`
+	UnionID      string `json:"unionid,omitempty"`
+	// IsSnapshotUser is 1 for the virtual user of a page opened in WeChat's
+	// snapshot preview, whose OpenID does not belong to a real person
+	IsSnapshotUser int `json:"is_snapshotuser"`
+}
+
+// OAuthUserInfo is the profile returned by the userinfo API
+type OAuthUserInfo struct {
+	OpenID     string `json:"openid"`
+	Nickname   string `json:"nickname"`
+	Sex        int    `json:"sex"`
+	Province   string `json:"province"`
+	City       string `json:"city"`
+	Country    string `json:"country"`
+	HeadImgURL string `json:"headimgurl"`
+	UnionID    string `json:"unionid,omitempty"`
+}
+
+// OAuthAuthorizeURL returns the Official Account's authorize page, which
+// sends the user back to the account's redirect URL with a code and state
+func (m *WeChatManager) OAuthAuthorizeURL(appName, scope, state string) (string, error) {
+	_, app, err := m.app(appName, config.WeChatAppOfficialAccount)
+	if err != nil {
+		return "", err
+	}
+
+	// WeChat requires the parameters in this order, which Encode keeps by sorting
+	query := url.Values{
+		"appid":         {app.AppID},
+		"redirect_uri":  {app.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {scope},
+		"state":         {state},
+	}
+	return m.config.AuthorizeURL + "?" + query.Encode() + "#wechat_redirect", nil
+}
+
+// OAuthRedirectURL returns the URL WeChat sends the users of an Official
+// Account back to
+func (m *WeChatManager) OAuthRedirectURL(appName string) (*url.URL, error) {
+	_, app, err := m.app(appName, config.WeChatAppOfficialAccount)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(app.RedirectURL)
+}
+
+// OAuthReturnURLAllowed reports whether a web login with the Official Account
+// may return to returnURL, one of the account's return URLs with any query
+func (m *WeChatManager) OAuthReturnURLAllowed(appName, returnURL string) bool {
+	_, app, err := m.app(appName, config.WeChatAppOfficialAccount)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(returnURL)
+	if err != nil || u.Fragment != "" {
+		return false
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return slices.Contains(app.ReturnURLs, u.String())
+}
+
+// OAuthExchange exchanges the code from an Official Account OAuth2 redirect
+// for the user's OpenID and web access token
+func (m *WeChatManager) OAuthExchange(ctx context.Context, appName, code string) (*OAuthToken, error) {
+	_, app, err := m.app(appName, config.WeChatAppOfficialAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"appid":      {app.AppID},
+		"secret":     {app.AppSecret},
+		"code":       {code},
+		"grant_type": {"authorization_code"},
+	}
+
+	var token OAuthToken
+	if err := m.call(ctx, http.MethodGet, WeChatOAuthTokenPath, query, nil, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// OAuthUserInfo fetches the profile of a user who granted snsapi_userinfo
+func (m *WeChatManager) OAuthUserInfo(ctx context.Context, token *OAuthToken) (*OAuthUserInfo, error) {
+	query := url.Values{
+		"access_token": {token.AccessToken},
+		"openid":       {token.OpenID},
+		"lang":         {"zh_CN"},
+	}
+
+	var info OAuthUserInfo
+	if err := m.call(ctx, http.MethodGet, WeChatOAuthUserInfoPath, query, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
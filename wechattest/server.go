@@ -0,0 +1,373 @@
+// Package wechattest provides a fake WeChat API server, so the WeChat login
+// paths can be exercised without reaching api.weixin.qq.com. Point
+// WeChatConfig.APIBaseURL at the server's URL.
+package wechattest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LIUHUANUCAS/auth/utils"
+)
+
+// WeChat errcodes answered by the fake server
+const (
+	ErrCodeSystemBusy         = -1
+	ErrCodeInvalidCredential  = 40001
+	ErrCodeInvalidAppID       = 40013
+	ErrCodeInvalidCode        = 40029
+	ErrCodeInvalidAppSecret   = 40125
+	ErrCodeAccessTokenExpired = 42001
+	ErrCodeRateLimited        = 45011
+	ErrCodeHighRiskUser       = 40226
+)
+
+// errMsgs are the errmsgs WeChat sends with the errcodes above
+var errMsgs = map[int]string{
+	ErrCodeSystemBusy:         "system error",
+	ErrCodeInvalidCredential:  "invalid credential, access_token is invalid or not latest",
+	ErrCodeInvalidAppID:       "invalid appid",
+	ErrCodeInvalidCode:        "invalid code",
+	ErrCodeInvalidAppSecret:   "invalid appsecret",
+	ErrCodeAccessTokenExpired: "access_token expired",
+	ErrCodeRateLimited:        "api minute-quota reach limit mustslower retry next minute",
+	ErrCodeHighRiskUser:       "high risk user",
+}
+
+// ErrorCodePrefix starts a code that makes the API it is sent to answer an
+// errcode, e.g. "errcode:40029", so errors can be triggered from a client
+const ErrorCodePrefix = "errcode:"
+
+// Session is what jscode2session returns for a code
+type Session struct {
+	OpenID     string
+	UnionID    string
+	SessionKey string
+}
+
+// Phone is what getuserphonenumber returns for a code
+type Phone struct {
+	CountryCode string
+	Number      string
+}
+
+// accessToken is the current access_token of an app
+type accessToken struct {
+	token   string
+	expires time.Time
+}
+
+// failure is an errcode scripted for the next calls to an API
+type failure struct {
+	code  int
+	times int
+}
+
+// Server is a fake WeChat API server. Codes it has not been given a session
+// or phone number for get ones derived from the code, so a code always logs
+// in the same user: "alice" is alice in every app, with an OpenID per app and
+// one UnionID. Unlike WeChat's, codes can be used more than once. Only apps
+// added with AddApp are accepted.
+type Server struct {
+	// AccessTokenTTL is the expires_in of the access_tokens issued
+	AccessTokenTTL time.Duration
+
+	mu       sync.Mutex
+	apps     map[string]string
+	tokens   map[string]*accessToken
+	sessions map[string]Session
+	phones   map[string]Phone
+	failures map[string][]failure
+	calls    map[string]int
+	issued   int
+}
+
+// NewServer creates a new fake WeChat server, an http.Handler to serve with
+// httptest.NewServer or http.ListenAndServe
+func NewServer() *Server {
+	return &Server{
+		AccessTokenTTL: 2 * time.Hour,
+		apps:           make(map[string]string),
+		tokens:         make(map[string]*accessToken),
+		sessions:       make(map[string]Session),
+		phones:         make(map[string]Phone),
+		failures:       make(map[string][]failure),
+		calls:          make(map[string]int),
+	}
+}
+
+// AddApp accepts the app with the given credentials
+func (s *Server) AddApp(appID, appSecret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apps[appID] = appSecret
+}
+
+// AddSession makes jscode2session answer session for code
+func (s *Server) AddSession(code string, session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[code] = session
+}
+
+// AddPhone makes getuserphonenumber answer phone for code
+func (s *Server) AddPhone(code string, phone Phone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phones[code] = phone
+}
+
+// Fail makes the next times calls to the API at path, e.g.
+// utils.WeChatCode2SessionPath, answer errcode. Failures queue up behind the
+// ones already scripted.
+func (s *Server) Fail(path string, errcode, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], failure{code: errcode, times: times})
+}
+
+// RevokeAccessToken invalidates the app's access_token, as a forced refresh
+// by another client would; calls with it answer 40001
+func (s *Server) RevokeAccessToken(appID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, appID)
+}
+
+// Calls returns how often the API at path has been called
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// ServeHTTP serves the WeChat APIs
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp any
+	switch r.URL.Path {
+	case utils.WeChatCode2SessionPath:
+		resp = s.code2Session(r)
+	case utils.WeChatStableTokenPath:
+		resp = s.stableToken(r)
+	case utils.WeChatPhoneNumberPath:
+		resp = s.phoneNumber(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) code2Session(r *http.Request) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errResp := s.begin(r.URL.Path); errResp != nil {
+		return errResp
+	}
+	if r.Method != http.MethodGet {
+		return errorResponse(ErrCodeSystemBusy)
+	}
+
+	query := r.URL.Query()
+	appID := query.Get("appid")
+	if errResp := s.checkApp(appID, query.Get("secret")); errResp != nil {
+		return errResp
+	}
+
+	code := query.Get("js_code")
+	if errResp := checkCode(code); errResp != nil {
+		return errResp
+	}
+
+	session, ok := s.sessions[code]
+	if !ok {
+		session = Session{
+			OpenID:     "o" + digest("openid", appID, code)[:27],
+			UnionID:    "u" + digest("unionid", code)[:27],
+			SessionKey: base64.StdEncoding.EncodeToString([]byte(digest("session_key", appID, code)[:16])),
+		}
+	}
+
+	return map[string]any{
+		"openid":      session.OpenID,
+		"session_key": session.SessionKey,
+		"unionid":     session.UnionID,
+	}
+}
+
+func (s *Server) stableToken(r *http.Request) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errResp := s.begin(r.URL.Path); errResp != nil {
+		return errResp
+	}
+
+	var req struct {
+		GrantType    string `json:"grant_type"`
+		AppID        string `json:"appid"`
+		Secret       string `json:"secret"`
+		ForceRefresh bool   `json:"force_refresh"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.GrantType != "client_credential" {
+		return errorResponse(ErrCodeSystemBusy)
+	}
+	if errResp := s.checkApp(req.AppID, req.Secret); errResp != nil {
+		return errResp
+	}
+
+	token, ok := s.tokens[req.AppID]
+	if !ok || req.ForceRefresh || time.Now().After(token.expires) {
+		s.issued++
+		token = &accessToken{
+			token:   fmt.Sprintf("ACCESS_TOKEN_%s_%d", req.AppID, s.issued),
+			expires: time.Now().Add(s.AccessTokenTTL),
+		}
+		s.tokens[req.AppID] = token
+	}
+
+	return map[string]any{
+		"access_token": token.token,
+		"expires_in":   int64(time.Until(token.expires).Seconds()),
+	}
+}
+
+func (s *Server) phoneNumber(r *http.Request) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errResp := s.begin(r.URL.Path); errResp != nil {
+		return errResp
+	}
+	if r.Method != http.MethodPost {
+		return errorResponse(ErrCodeSystemBusy)
+	}
+
+	appID, errResp := s.checkAccessToken(r.URL.Query().Get("access_token"))
+	if errResp != nil {
+		return errResp
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errorResponse(ErrCodeSystemBusy)
+	}
+	if errResp := checkCode(req.Code); errResp != nil {
+		return errResp
+	}
+
+	phone, ok := s.phones[req.Code]
+	if !ok {
+		// A mainland mobile number, 138 followed by eight digits
+		sum := sha256.Sum256([]byte(req.Code))
+		phone = Phone{
+			CountryCode: "86",
+			Number:      fmt.Sprintf("138%08d", binary.BigEndian.Uint32(sum[:4])%100000000),
+		}
+	}
+
+	number := phone.Number
+	if phone.CountryCode != "86" {
+		number = "+" + phone.CountryCode + phone.Number
+	}
+	return map[string]any{
+		"errcode": 0,
+		"errmsg":  "ok",
+		"phone_info": map[string]any{
+			"phoneNumber":     number,
+			"purePhoneNumber": phone.Number,
+			"countryCode":     phone.CountryCode,
+			"watermark": map[string]any{
+				"appid":     appID,
+				"timestamp": time.Now().Unix(),
+			},
+		},
+	}
+}
+
+// begin counts a call to the API at path and returns the error response
+// scripted for it, if any
+func (s *Server) begin(path string) any {
+	s.calls[path]++
+
+	queue := s.failures[path]
+	if len(queue) == 0 {
+		return nil
+	}
+	code := queue[0].code
+	if queue[0].times--; queue[0].times <= 0 {
+		s.failures[path] = queue[1:]
+	}
+	return errorResponse(code)
+}
+
+// checkApp returns the error response for unknown app credentials
+func (s *Server) checkApp(appID, secret string) any {
+	expected, ok := s.apps[appID]
+	if !ok {
+		return errorResponse(ErrCodeInvalidAppID)
+	}
+	if secret != expected {
+		return errorResponse(ErrCodeInvalidAppSecret)
+	}
+	return nil
+}
+
+// checkAccessToken returns the app an access_token was issued to, or the
+// error response for an invalid one
+func (s *Server) checkAccessToken(token string) (string, any) {
+	for appID, current := range s.tokens {
+		if current.token != token {
+			continue
+		}
+		if time.Now().After(current.expires) {
+			return "", errorResponse(ErrCodeAccessTokenExpired)
+		}
+		return appID, nil
+	}
+	return "", errorResponse(ErrCodeInvalidCredential)
+}
+
+// checkCode returns the error response for a code that is empty or asks for an error
+func checkCode(code string) any {
+	if code == "" {
+		return errorResponse(ErrCodeInvalidCode)
+	}
+	if errcode, ok := strings.CutPrefix(code, ErrorCodePrefix); ok {
+		if n, err := strconv.Atoi(errcode); err == nil {
+			return errorResponse(n)
+		}
+	}
+	return nil
+}
+
+func errorResponse(errcode int) map[string]any {
+	msg, ok := errMsgs[errcode]
+	if !ok {
+		msg = "error"
+	}
+	return map[string]any{
+		"errcode": errcode,
+		"errmsg":  msg,
+	}
+}
+
+// digest derives a stable hex identifier from parts
+func digest(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}